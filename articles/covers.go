@@ -0,0 +1,70 @@
+package articles
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// The limits of an uploaded cover image, it is stored scaled down to CoverWidth.
+var (
+	CoverMaxSize      int64 = 10 << 20
+	CoverMaxDimension       = 8192
+	CoverWidth              = 1600
+)
+
+// You could replace the cover image of an article by an uploaded image stored in common.MediaStorage,
+// the file of the previous cover is removed.
+// 	err := articleModel.setCover(file)
+func (article *ArticleModel) setCover(r io.Reader) error {
+	img, format, err := common.DecodeImage(r, "Cover", CoverMaxSize, CoverMaxDimension)
+	if err != nil {
+		return err
+	}
+	ext, contentType := common.ImageType(format)
+	data, err := common.EncodeImage(common.FitWidth(img, CoverWidth), format)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("covers/%d/%s%s", article.ID, common.RandString(16), ext)
+	if err := common.MediaStorage.Put(key, bytes.NewReader(data), contentType); err != nil {
+		return err
+	}
+	previous := article.CoverKey
+	if err := article.Update(map[string]interface{}{"cover_key": key}); err != nil {
+		common.MediaStorage.Delete(key)
+		return err
+	}
+	return removeCoverFile(previous)
+}
+
+// You could remove the cover image of an article.
+// 	err := articleModel.removeCover()
+func (article *ArticleModel) removeCover() error {
+	if article.CoverKey == "" {
+		return nil
+	}
+	previous := article.CoverKey
+	if err := article.Update(map[string]interface{}{"cover_key": ""}); err != nil {
+		return err
+	}
+	return removeCoverFile(previous)
+}
+
+func removeCoverFile(key string) error {
+	if key == "" {
+		return nil
+	}
+	return common.MediaStorage.Delete(key)
+}
+
+// The public address of the cover image, nil when the article has none.
+func (article ArticleModel) coverURL() *string {
+	if article.CoverKey == "" {
+		return nil
+	}
+	url := common.MediaStorage.URL(article.CoverKey)
+	return &url
+}
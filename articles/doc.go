@@ -8,5 +8,21 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+exports.go: the articles, comments and favorites added to the personal data export of a user
+
+slugs.go: the unique slugs of the articles and the history of their old slugs
+
+publishing.go: the drafts, the statuses of the articles and the scheduled publishing
+
+revisions.go: the revisions of the articles, their diffs and restoring an old one
+
+rendering.go: the Markdown of the articles and comments rendered to sanitized HTML
+
+search.go: the full-text search of the articles, with SQLite FTS5 or LIKE queries
+
+covers.go: the cover images of the articles kept in the media storage
+
+suggestions.go: who-to-follow suggestions from the favorited articles and their tags
 */
 package articles
@@ -0,0 +1,164 @@
+package articles
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+type articleExport struct {
+	Slug        string   `json:"slug"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Body        string   `json:"body"`
+	Tags        []string `json:"tagList"`
+	Status      string   `json:"status"`
+	CreatedAt   string   `json:"createdAt"`
+	UpdatedAt   string   `json:"updatedAt"`
+}
+
+type commentExport struct {
+	Article   string `json:"article"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+type favoriteExport struct {
+	Article     string `json:"article"`
+	Title       string `json:"title"`
+	FavoritedAt string `json:"favoritedAt"`
+}
+
+func exportTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.999Z")
+}
+
+// The markdown copy of an article, the metadata goes to a front matter block.
+func (article articleExport) markdown() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "---\ntitle: %q\nslug: %q\ndescription: %q\nstatus: %s\ntags: [", article.Title, article.Slug, article.Description, article.Status)
+	for i, tag := range article.Tags {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%q", tag)
+	}
+	fmt.Fprintf(&b, "]\ncreatedAt: %s\nupdatedAt: %s\n---\n\n# %s\n\n%s\n", article.CreatedAt, article.UpdatedAt, article.Title, article.Body)
+	return []byte(b.String())
+}
+
+// The articles with their tags, the comments with their article and the favorites with their article of the user.
+// An error fails the whole export rather than leaving things out of it, the comments and favorites of a deleted
+// article keep an empty one.
+func loadUserContent(tx *gorm.DB, articleUserModel ArticleUserModel, articleModels *[]ArticleModel,
+	commentModels *[]CommentModel, favoriteModels *[]FavoriteModel) error {
+	if err := tx.Where(&ArticleModel{AuthorID: articleUserModel.ID}).Order("id").Find(articleModels).Error; err != nil {
+		return err
+	}
+	for i := range *articleModels {
+		if err := tx.Model(&(*articleModels)[i]).Related(&(*articleModels)[i].Tags, "Tags").Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Where(&CommentModel{AuthorID: articleUserModel.ID}).Order("id").Find(commentModels).Error; err != nil {
+		return err
+	}
+	for i := range *commentModels {
+		err := tx.Model(&(*commentModels)[i]).Related(&(*commentModels)[i].Article, "Article").Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+	}
+	if err := tx.Where(&FavoriteModel{FavoriteByID: articleUserModel.ID}).Order("id").Find(favoriteModels).Error; err != nil {
+		return err
+	}
+	for i := range *favoriteModels {
+		err := tx.Model(&(*favoriteModels)[i]).Related(&(*favoriteModels)[i].Favorite, "Favorite").Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportUserContent is the users.ExportSection of this module: the articles with their tags as JSON and Markdown,
+// the comments and the favorites of the user. Register it with
+// 	users.RegisterExportSection(articles.ExportUserContent)
+func ExportUserContent(userModel users.UserModel) (map[string][]byte, error) {
+	db := common.GetDB()
+	files := make(map[string][]byte)
+	var articleUserModel ArticleUserModel
+	err := db.Where(&ArticleUserModel{UserModelID: userModel.ID}).First(&articleUserModel).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	var articleModels []ArticleModel
+	var commentModels []CommentModel
+	var favoriteModels []FavoriteModel
+	if articleUserModel.ID != 0 {
+		tx := db.Begin()
+		if err := loadUserContent(tx, articleUserModel, &articleModels, &commentModels, &favoriteModels); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return nil, err
+		}
+	}
+
+	articles := []articleExport{}
+	for _, articleModel := range articleModels {
+		article := articleExport{
+			Slug:        articleModel.Slug,
+			Title:       articleModel.Title,
+			Description: articleModel.Description,
+			Body:        articleModel.Body,
+			Tags:        []string{},
+			Status:      articleModel.Status,
+			CreatedAt:   exportTime(articleModel.CreatedAt),
+			UpdatedAt:   exportTime(articleModel.UpdatedAt),
+		}
+		for _, tagModel := range articleModel.Tags {
+			article.Tags = append(article.Tags, tagModel.Tag)
+		}
+		articles = append(articles, article)
+		files[fmt.Sprintf("articles/%d-%s.md", articleModel.ID, articleModel.Slug)] = article.markdown()
+	}
+	comments := []commentExport{}
+	for _, commentModel := range commentModels {
+		comments = append(comments, commentExport{
+			Article:   commentModel.Article.Slug,
+			Body:      commentModel.Body,
+			CreatedAt: exportTime(commentModel.CreatedAt),
+			UpdatedAt: exportTime(commentModel.UpdatedAt),
+		})
+	}
+	favorites := []favoriteExport{}
+	for _, favoriteModel := range favoriteModels {
+		favorites = append(favorites, favoriteExport{
+			Article:     favoriteModel.Favorite.Slug,
+			Title:       favoriteModel.Favorite.Title,
+			FavoritedAt: exportTime(favoriteModel.CreatedAt),
+		})
+	}
+
+	for name, content := range map[string]interface{}{
+		"articles.json":  articles,
+		"comments.json":  comments,
+		"favorites.json": favorites,
+	} {
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files[name] = data
+	}
+	return files, nil
+}
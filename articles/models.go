@@ -5,7 +5,9 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"log"
 	"strconv"
+	"time"
 )
 
 type ArticleModel struct {
@@ -18,6 +20,11 @@ type ArticleModel struct {
 	AuthorID    uint
 	Tags        []TagModel     `gorm:"many2many:article_tags;"`
 	Comments    []CommentModel `gorm:"ForeignKey:ArticleID"`
+	CoverKey    string
+	// See publishing.go, the articles created before the statuses existed are published.
+	Status      string `gorm:"index;default:'published'"`
+	PublishAt   *time.Time
+	PublishedAt *time.Time
 }
 
 type ArticleUserModel struct {
@@ -112,7 +119,10 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	db := common.GetDB()
 	var model ArticleModel
 	tx := db.Begin()
-	tx.Where(condition).First(&model)
+	if err := tx.Where(condition).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
 	tx.Model(&model).Related(&model.Author, "Author")
 	tx.Model(&model.Author).Related(&model.Author.UserModel)
 	tx.Model(&model).Related(&model.Tags, "Tags")
@@ -120,10 +130,42 @@ func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	return model, err
 }
 
-func (self *ArticleModel) getComments() error {
+// The condition is given as to gorm Where, a struct leaves its zero fields out of the query, so prefer
+// 	commentModel, err := FindOneComment("id = ? AND article_id = ?", id, articleModel.ID)
+func FindOneComment(condition interface{}, args ...interface{}) (CommentModel, error) {
+	db := common.GetDB()
+	var model CommentModel
+	tx := db.Begin()
+	if err := tx.Where(condition, args...).First(&model).Error; err != nil {
+		tx.Rollback()
+		return model, err
+	}
+	tx.Model(&model).Related(&model.Author, "Author")
+	tx.Model(&model.Author).Related(&model.Author.UserModel)
+	err := tx.Commit().Error
+	return model, err
+}
+
+// Comment can be deleted by its author, the author of the article or a moderator.
+func (comment CommentModel) canBeDeletedBy(article ArticleModel, user users.UserModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	return comment.Author.UserModelID == user.ID || article.Author.UserModelID == user.ID || user.IsModerator()
+}
+
+// The author of an article and the moderators are allowed to change it.
+func (article ArticleModel) canBeEditedBy(user users.UserModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	return article.Author.UserModelID == user.ID || user.IsModerator()
+}
+
+func (self *ArticleModel) getComments(viewer users.UserModel) error {
 	db := common.GetDB()
 	tx := db.Begin()
-	tx.Model(self).Related(&self.Comments, "Comments")
+	withoutAuthors(tx.Model(self), users.HiddenUserIDs(viewer)).Related(&self.Comments, "Comments")
 	for i, _ := range self.Comments {
 		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Author, "Author")
 		tx.Model(&self.Comments[i].Author).Related(&self.Comments[i].Author.UserModel)
@@ -139,7 +181,68 @@ func getAllTags() ([]TagModel, error) {
 	return models, err
 }
 
-func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
+// Leave out the articles or comments written by the given users.
+func withoutAuthors(query *gorm.DB, userIDs []uint) *gorm.DB {
+	if len(userIDs) == 0 {
+		return query
+	}
+	db := common.GetDB()
+	return query.Where("author_id NOT IN (?)",
+		db.Model(&ArticleUserModel{}).Select("id").Where("user_model_id IN (?)", userIDs).QueryExpr())
+}
+
+// Leave out the articles or comments of the private users the viewer doesn't follow.
+func withoutPrivateAuthors(query *gorm.DB, viewer users.UserModel) *gorm.DB {
+	db := common.GetDB()
+	return query.Where("author_id NOT IN (?)",
+		db.Model(&ArticleUserModel{}).Select("id").Where("user_model_id IN (?)", users.PrivateUsersHiddenFrom(viewer)).QueryExpr())
+}
+
+// Only keep the articles the viewer is allowed and wants to see: the authors the viewer blocked, muted
+// or is blocked by are left out, so are the private authors the viewer doesn't follow and the articles
+// of the other users which aren't published.
+func visibleArticles(query *gorm.DB, viewer users.UserModel) *gorm.DB {
+	query = withoutPrivateAuthors(withoutAuthors(query, users.HiddenUserIDs(viewer)), viewer)
+	return publishedOrOwnArticles(query, viewer)
+}
+
+// The single article version of visibleArticles, blocks and mutes don't apply to a direct link.
+func (article ArticleModel) visibleTo(viewer users.UserModel) bool {
+	return article.publishedOrOwnedBy(viewer) && viewer.CanViewContentOf(article.Author.UserModel)
+}
+
+// The articles the viewer can see with the filters of ArticleList, the empty ones are left out.
+// It returns false when the author or favorited user doesn't exist, no article matches then.
+func filteredArticles(tx *gorm.DB, tag, author, favorited string, viewer users.UserModel) (*gorm.DB, bool) {
+	query := visibleArticles(tx.Model(&ArticleModel{}), viewer)
+	if tag != "" {
+		query = query.Where("id IN (?)", tx.Table("article_tags").Select("article_tags.article_model_id").
+			Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+			Where("tag_models.tag = ? AND tag_models.deleted_at IS NULL", tag).QueryExpr())
+	}
+	if author != "" {
+		var userModel users.UserModel
+		tx.Where(users.UserModel{Username: author}).First(&userModel)
+		if userModel.ID == 0 {
+			return query, false
+		}
+		articleUserModel := GetArticleUserModel(userModel)
+		query = query.Where("author_id = ?", articleUserModel.ID)
+	}
+	if favorited != "" {
+		var userModel users.UserModel
+		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
+		if userModel.ID == 0 {
+			return query, false
+		}
+		articleUserModel := GetArticleUserModel(userModel)
+		query = query.Where("id IN (?)", tx.Model(&FavoriteModel{}).Select("favorite_id").
+			Where("favorite_by_id = ?", articleUserModel.ID).QueryExpr())
+	}
+	return query, true
+}
+
+func FindManyArticle(tag, author, limit, offset, favorited string, viewer users.UserModel) ([]ArticleModel, int, error) {
 	db := common.GetDB()
 	var models []ArticleModel
 	var count int
@@ -155,43 +258,12 @@ func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleMod
 	}
 
 	tx := db.Begin()
-	if tag != "" {
-		var tagModel TagModel
-		tx.Where(TagModel{Tag: tag}).First(&tagModel)
-		if tagModel.ID != 0 {
-			tx.Model(&tagModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-			count = tx.Model(&tagModel).Association("ArticleModels").Count()
-		}
-	} else if author != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: author}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-
-		if articleUserModel.ID != 0 {
-			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
-			tx.Model(&articleUserModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-		}
-	} else if favorited != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-		if articleUserModel.ID != 0 {
-			var favoriteModels []FavoriteModel
-			tx.Where(FavoriteModel{
-				FavoriteByID: articleUserModel.ID,
-			}).Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
-
-			count = tx.Model(&articleUserModel).Association("FavoriteModels").Count()
-			for _, favorite := range favoriteModels {
-				var model ArticleModel
-				tx.Model(&favorite).Related(&model, "Favorite")
-				models = append(models, model)
-			}
-		}
-	} else {
-		db.Model(&models).Count(&count)
-		db.Offset(offset_int).Limit(limit_int).Find(&models)
+	query, ok := filteredArticles(tx, tag, author, favorited, viewer)
+	if !ok {
+		return models, count, tx.Commit().Error
 	}
+	query.Count(&count)
+	query.Offset(offset_int).Limit(limit_int).Find(&models)
 
 	for i, _ := range models {
 		tx.Model(&models[i]).Related(&models[i].Author, "Author")
@@ -224,7 +296,9 @@ func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleMod
 		articleUserModels = append(articleUserModels, articleUserModel.ID)
 	}
 
-	tx.Where("author_id in (?)", articleUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+	query := visibleArticles(tx.Model(&ArticleModel{}), self.UserModel).Where("author_id in (?)", articleUserModels)
+	query.Count(&count)
+	query.Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
 
 	for i, _ := range models {
 		tx.Model(&models[i]).Related(&models[i].Author, "Author")
@@ -256,14 +330,164 @@ func (model *ArticleModel) Update(data interface{}) error {
 	return err
 }
 
+// You could apply the changes of an ArticleModelValidator, the slug follows the title and a revision of the editor
+// is saved, all in one transaction. The author stays the same whoever edits, moderators included.
+// 	err := articleModel.edit(articleModelValidator.articleModel, GetArticleUserModel(myUserModel))
+func (model *ArticleModel) edit(changes ArticleModel, editor ArticleUserModel) error {
+	previous := *model
+	changes.ID = model.ID
+	changes.Author, changes.AuthorID = ArticleUserModel{}, 0
+	return model.saveChange(func(tx *gorm.DB) error {
+		if err := model.setSlugFromTitle(tx, changes.Title); err != nil {
+			return err
+		}
+		if err := tx.Model(model).Update(changes).Error; err != nil {
+			return err
+		}
+		// Update with a struct skips the blank fields, unscheduling clears publish_at.
+		err := tx.Model(model).Update(map[string]interface{}{
+			"status":       changes.Status,
+			"publish_at":   changes.PublishAt,
+			"published_at": changes.PublishedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return model.addRevision(tx, previous, editor, 0)
+	})
+}
+
+// The cover images of the deleted articles are removed from common.MediaStorage once the deletion is committed,
+// a failure to remove one is logged since the articles are already gone.
 func DeleteArticleModel(condition interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(ArticleModel{}).Error
-	return err
+	tx := db.Begin()
+	var articleModels []ArticleModel
+	if err := tx.Select("id, cover_key").Where(condition).Find(&articleModels).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where(condition).Delete(ArticleModel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, articleModel := range articleModels {
+		if err := DefaultSearchEngine.Remove(tx, articleModel.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	for _, articleModel := range articleModels {
+		if err := removeCoverFile(articleModel.CoverKey); err != nil {
+			log.Printf("delete article %v: cover %s not removed: %v", articleModel.ID, articleModel.CoverKey, err)
+		}
+	}
+	return nil
 }
 
-func DeleteCommentModel(condition interface{}) error {
+// It returns gorm.ErrRecordNotFound when no comment matched the condition, given as to FindOneComment.
+func DeleteCommentModel(condition interface{}, args ...interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(CommentModel{}).Error
-	return err
+	result := db.Where(condition, args...).Delete(CommentModel{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// What happens to the articles and comments of a deleted account:
+// they are either deleted with it or reassigned to the placeholder author of deleted users.
+const (
+	DeletedUserContentDelete    = "delete"
+	DeletedUserContentAnonymize = "anonymize"
+)
+
+var DeletedUserContent = DeletedUserContentAnonymize
+
+// The placeholder author shown instead of deleted users, it is the only ArticleUserModel without a UserModel.
+func getDeletedArticleUserModel(tx *gorm.DB) (ArticleUserModel, error) {
+	var articleUserModel ArticleUserModel
+	err := tx.Where("user_model_id = ?", 0).FirstOrCreate(&articleUserModel).Error
+	return articleUserModel, err
+}
+
+// DeleteUserContent is the users.AccountDeletionHook of this module, register it with
+// 	users.RegisterAccountDeletionHook(articles.DeleteUserContent)
+// The covers of the deleted articles are returned for DeleteAccount to remove after its commit.
+func DeleteUserContent(tx *gorm.DB, userModel users.UserModel) ([]string, error) {
+	var articleUserModel ArticleUserModel
+	err := tx.Unscoped().Where(&ArticleUserModel{UserModelID: userModel.ID}).First(&articleUserModel).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where(FavoriteModel{FavoriteByID: articleUserModel.ID}).Delete(FavoriteModel{}).Error; err != nil {
+		return nil, err
+	}
+
+	var storageKeys []string
+	if DeletedUserContent == DeletedUserContentDelete {
+		var articleIDs []uint
+		if err := tx.Unscoped().Model(&ArticleModel{}).Where("author_id = ?", articleUserModel.ID).Pluck("id", &articleIDs).Error; err != nil {
+			return nil, err
+		}
+		err := tx.Unscoped().Model(&ArticleModel{}).Where("author_id = ? AND cover_key <> ?", articleUserModel.ID, "").
+			Pluck("cover_key", &storageKeys).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(articleIDs) > 0 {
+			if err := tx.Unscoped().Where("article_id IN (?)", articleIDs).Delete(CommentModel{}).Error; err != nil {
+				return nil, err
+			}
+			if err := tx.Unscoped().Where("favorite_id IN (?)", articleIDs).Delete(FavoriteModel{}).Error; err != nil {
+				return nil, err
+			}
+			if err := tx.Exec("DELETE FROM article_tags WHERE article_model_id IN (?)", articleIDs).Error; err != nil {
+				return nil, err
+			}
+			if err := tx.Unscoped().Where("article_id IN (?)", articleIDs).Delete(ArticleSlugModel{}).Error; err != nil {
+				return nil, err
+			}
+			if err := tx.Unscoped().Where("article_id IN (?)", articleIDs).Delete(ArticleRevisionModel{}).Error; err != nil {
+				return nil, err
+			}
+			if err := tx.Unscoped().Where("id IN (?)", articleIDs).Delete(ArticleModel{}).Error; err != nil {
+				return nil, err
+			}
+			for _, articleID := range articleIDs {
+				if err := DefaultSearchEngine.Remove(tx, articleID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err := tx.Unscoped().Where("author_id = ?", articleUserModel.ID).Delete(CommentModel{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	// The revisions of the articles of the others stay, whoever edited them.
+	if err := reassignRevisionEditor(tx, articleUserModel); err != nil {
+		return nil, err
+	}
+	if DeletedUserContent != DeletedUserContentDelete {
+		deletedArticleUserModel, err := getDeletedArticleUserModel(tx)
+		if err != nil {
+			return nil, err
+		}
+		for _, model := range []interface{}{&ArticleModel{}, &CommentModel{}} {
+			err := tx.Unscoped().Model(model).Where("author_id = ?", articleUserModel.ID).
+				UpdateColumn("author_id", deletedArticleUserModel.ID).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return storageKeys, tx.Unscoped().Delete(&articleUserModel).Error
 }
@@ -0,0 +1,77 @@
+package articles
+
+import (
+	"log"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// The statuses of an article, only the published ones are shown to the other users.
+// A scheduled article is published by the scheduler once its PublishAt is due.
+const (
+	ArticleDraft     = "draft"
+	ArticleScheduled = "scheduled"
+	ArticlePublished = "published"
+	ArticleArchived  = "archived"
+)
+
+// You could change the status of the article, publishAt is only used by ArticleScheduled. Scheduling at a time
+// already past publishes the article right away. It returns a common.FieldError on "Status" or "PublishAt".
+// 	err := articleModel.setStatus(ArticleScheduled, &publishAt, time.Now())
+func (model *ArticleModel) setStatus(status string, publishAt *time.Time, now time.Time) error {
+	switch status {
+	case ArticleDraft, ArticleArchived, ArticlePublished:
+		model.PublishAt = nil
+	case ArticleScheduled:
+		if publishAt == nil {
+			return common.FieldError{Field: "PublishAt", Message: "{key: required}"}
+		}
+		if publishAt.After(now) {
+			model.PublishAt = publishAt
+		} else {
+			status, now = ArticlePublished, *publishAt
+			model.PublishAt = nil
+		}
+	default:
+		return common.FieldError{Field: "Status", Message: "{key: oneof}"}
+	}
+	model.Status = status
+	if status == ArticlePublished && model.PublishedAt == nil {
+		model.PublishedAt = &now
+	}
+	return nil
+}
+
+// Only the published articles, or the ones of the viewer whatever their status.
+func publishedOrOwnArticles(query *gorm.DB, viewer users.UserModel) *gorm.DB {
+	return query.Where("status = ? OR author_id = ?", ArticlePublished, GetArticleUserModel(viewer).ID)
+}
+
+// The single article version of publishedOrOwnArticles.
+func (article ArticleModel) publishedOrOwnedBy(viewer users.UserModel) bool {
+	return article.Status == ArticlePublished || (viewer.ID != 0 && article.Author.UserModelID == viewer.ID)
+}
+
+// You could publish the scheduled articles whose PublishAt is due, it returns how many were published.
+// 	count, err := PublishDueArticles(time.Now())
+func PublishDueArticles(now time.Time) (int64, error) {
+	db := common.GetDB()
+	result := db.Model(&ArticleModel{}).Where("status = ? AND publish_at <= ?", ArticleScheduled, now).
+		Updates(map[string]interface{}{"status": ArticlePublished, "published_at": gorm.Expr("publish_at")})
+	return result.RowsAffected, result.Error
+}
+
+// Publish the due articles every interval until the process exits.
+// 	go articles.StartPublishScheduler(time.Minute)
+func StartPublishScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		if count, err := PublishDueArticles(time.Now()); err != nil {
+			log.Printf("publish scheduled articles: %v", err)
+		} else if count > 0 {
+			log.Printf("published %d scheduled articles", count)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package articles
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// CommonMark with the GFM tables, the fenced code blocks get a "language-go" like class for the highlighters
+// of the clients. The raw HTML of the Markdown is left out, what goldmark renders is sanitized anyway.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.Table))
+
+// Bump it when the rendering or the policies change, RenderStaleRevisions renders the HTML of the revisions again.
+const markdownVersion = 1
+
+var codeLanguageClass = regexp.MustCompile(`^language-[a-zA-Z0-9_+#.-]+$`)
+
+// The articles allow what user content usually does: headings, lists, tables, images, links...
+var articlePolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(codeLanguageClass).OnElements("code")
+	return p
+}()
+
+// The comments only allow formatting text and links, no images, headings or tables.
+var commentPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "del", "code", "pre", "blockquote", "ul", "ol", "li")
+	p.AllowAttrs("class").Matching(codeLanguageClass).OnElements("code")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowStandardURLs()
+	p.RequireNoFollowOnLinks(true)
+	return p
+}()
+
+// You could render Markdown to HTML safe to show with the policy, the source is shown escaped when
+// goldmark fails on it.
+// 	bodyHTML := renderMarkdown(articleModel.Body, articlePolicy)
+func renderMarkdown(source string, policy *bluemonday.Policy) string {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "<p>" + html.EscapeString(source) + "</p>"
+	}
+	return policy.Sanitize(buf.String())
+}
+
+// You could get the HTML of the bodies of the articles by article ID, in one query. It is the one saved with the
+// latest revision, the bodies older than the revisions or than the markdownVersion are rendered each time.
+// 	bodies := loadBodiesHTML(articleModels)
+func loadBodiesHTML(articles []ArticleModel) map[uint]string {
+	db := common.GetDB()
+	bodies := map[uint]string{}
+	var ids []uint
+	for _, article := range articles {
+		ids = append(ids, article.ID)
+	}
+	var revisions []ArticleRevisionModel
+	if len(ids) > 0 {
+		db.Select("article_id, body, body_html, body_html_version").Where("article_id IN (?)", ids).
+			Where("number = (SELECT MAX(number) FROM article_revision_models latest WHERE latest.article_id = article_revision_models.article_id)").
+			Find(&revisions)
+	}
+	latest := map[uint]ArticleRevisionModel{}
+	for _, revision := range revisions {
+		latest[revision.ArticleID] = revision
+	}
+	for _, article := range articles {
+		revision, ok := latest[article.ID]
+		if ok && revision.Body == article.Body && revision.BodyHTMLVersion == markdownVersion {
+			bodies[article.ID] = revision.BodyHTML
+		} else {
+			bodies[article.ID] = renderMarkdown(article.Body, articlePolicy)
+		}
+	}
+	return bodies
+}
+
+// You could render again the HTML saved with the revisions of an older markdownVersion, once at startup.
+// 	err := articles.RenderStaleRevisions(db)
+func RenderStaleRevisions(db *gorm.DB) error {
+	var revisions []ArticleRevisionModel
+	if err := db.Select("id, body").Where("body_html_version <> ?", markdownVersion).Find(&revisions).Error; err != nil {
+		return err
+	}
+	for _, revision := range revisions {
+		err := db.Model(&revision).UpdateColumns(map[string]interface{}{
+			"body_html":         renderMarkdown(revision.Body, articlePolicy),
+			"body_html_version": markdownVersion,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The HTML of the body of the comment, rendered with the stricter comment policy.
+func (comment CommentModel) bodyHTML() string {
+	return renderMarkdown(comment.Body, commentPolicy)
+}
@@ -0,0 +1,340 @@
+package articles
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// A saved state of the title, description and body of an article, one per change. Number counts from 1 for each
+// article, RestoredFrom is the number of the revision it was restored from, if any.
+type ArticleRevisionModel struct {
+	gorm.Model
+	Article      ArticleModel
+	ArticleID    uint `gorm:"unique_index:idx_article_revision"`
+	Number       uint `gorm:"unique_index:idx_article_revision"`
+	Editor       ArticleUserModel
+	EditorID     uint
+	Title        string
+	Description  string `gorm:"size:2048"`
+	Body         string `gorm:"size:2048"`
+	RestoredFrom uint
+	// The rendered body, see rendering.go.
+	BodyHTML        string `gorm:"type:text"`
+	BodyHTMLVersion int
+}
+
+func (revision ArticleRevisionModel) sameContent(article ArticleModel) bool {
+	return revision.Title == article.Title && revision.Description == article.Description && revision.Body == article.Body
+}
+
+// The text the diffs are made of.
+func (revision ArticleRevisionModel) text() string {
+	return fmt.Sprintf("# %s\n\n%s\n\n%s\n", revision.Title, revision.Description, revision.Body)
+}
+
+func latestRevision(tx *gorm.DB, articleID uint) (ArticleRevisionModel, error) {
+	var revision ArticleRevisionModel
+	err := tx.Where(ArticleRevisionModel{ArticleID: articleID}).Order("number DESC").First(&revision).Error
+	return revision, err
+}
+
+// You could save the current state of the article as its next revision, nothing is saved when it didn't change.
+// The articles older than the revisions get their state before the change saved first, as revision 1 of the author.
+// 	err := articleModel.addRevision(tx, previous, GetArticleUserModel(myUserModel), 0)
+func (model ArticleModel) addRevision(tx *gorm.DB, previous ArticleModel, editor ArticleUserModel, restoredFrom uint) error {
+	latest, err := latestRevision(tx, model.ID)
+	if gorm.IsRecordNotFoundError(err) && previous.ID != 0 {
+		latest = ArticleRevisionModel{
+			Model:       gorm.Model{CreatedAt: previous.UpdatedAt},
+			ArticleID:   previous.ID,
+			Number:      1,
+			EditorID:    previous.AuthorID,
+			Title:       previous.Title,
+			Description: previous.Description,
+			Body:        previous.Body,
+		}
+		err = tx.Create(&latest).Error
+	} else if gorm.IsRecordNotFoundError(err) {
+		err = nil
+	}
+	if err != nil || (latest.ID != 0 && latest.sameContent(model)) {
+		return err
+	}
+	return tx.Create(&ArticleRevisionModel{
+		ArticleID:       model.ID,
+		Number:          latest.Number + 1,
+		EditorID:        editor.ID,
+		Title:           model.Title,
+		Description:     model.Description,
+		Body:            model.Body,
+		RestoredFrom:    restoredFrom,
+		BodyHTML:        renderMarkdown(model.Body, articlePolicy),
+		BodyHTMLVersion: markdownVersion,
+	}).Error
+}
+
+// You could get the revisions of the article with their editors, the most recent first.
+func (model ArticleModel) getRevisions() ([]ArticleRevisionModel, error) {
+	db := common.GetDB()
+	var revisions []ArticleRevisionModel
+	tx := db.Begin()
+	tx.Where(ArticleRevisionModel{ArticleID: model.ID}).Order("number DESC").Find(&revisions)
+	for i := range revisions {
+		tx.Model(&revisions[i]).Related(&revisions[i].Editor, "Editor")
+		tx.Model(&revisions[i].Editor).Related(&revisions[i].Editor.UserModel)
+	}
+	err := tx.Commit().Error
+	return revisions, err
+}
+
+// You could find a revision of the article by its number, 0 being the latest one.
+// 	revision, err := articleModel.findRevision(2)
+func (model ArticleModel) findRevision(number uint) (ArticleRevisionModel, error) {
+	db := common.GetDB()
+	if number == 0 {
+		return latestRevision(db, model.ID)
+	}
+	var revision ArticleRevisionModel
+	err := db.Where(ArticleRevisionModel{ArticleID: model.ID, Number: number}).First(&revision).Error
+	return revision, err
+}
+
+// The revisions edited by a deleted user are shown as edited by the placeholder author of deleted users.
+func reassignRevisionEditor(tx *gorm.DB, articleUserModel ArticleUserModel) error {
+	var count int
+	if err := tx.Unscoped().Model(&ArticleRevisionModel{}).Where("editor_id = ?", articleUserModel.ID).Count(&count).Error; err != nil || count == 0 {
+		return err
+	}
+	deletedArticleUserModel, err := getDeletedArticleUserModel(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Model(&ArticleRevisionModel{}).Where("editor_id = ?", articleUserModel.ID).
+		UpdateColumn("editor_id", deletedArticleUserModel.ID).Error
+}
+
+// How many unchanged lines are shown around the changes of a diff.
+const diffContext = 3
+
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// The lines of a and b with ' ' for the common ones, '-' for the ones only in a and '+' for the ones only in b,
+// from the shortest edit script of Myers, found in linear space by splitting a and b at the middle of the script.
+// See "An O(ND) Difference Algorithm and Its Variations", E. Myers, 1986.
+func diffLines(a, b []string) []diffLine {
+	lines := appendDiffLines(nil, a, b)
+	// The removed lines of a change go before the added ones, whatever half of the script they come from.
+	for start := 0; start < len(lines); start++ {
+		end := start
+		for end < len(lines) && lines[end].op != ' ' {
+			end++
+		}
+		change := lines[start:end]
+		sort.SliceStable(change, func(i, j int) bool { return change[i].op == '-' && change[j].op == '+' })
+		start = end
+	}
+	return lines
+}
+
+func appendDiffLines(lines []diffLine, a, b []string) []diffLine {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		lines = append(lines, diffLine{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	common := 0
+	for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+		common++
+	}
+	suffix := a[len(a)-common:]
+	a, b = a[:len(a)-common], b[:len(b)-common]
+	if len(a) == 0 || len(b) == 0 {
+		for _, line := range a {
+			lines = append(lines, diffLine{'-', line})
+		}
+		for _, line := range b {
+			lines = append(lines, diffLine{'+', line})
+		}
+	} else {
+		x, y := middleSnake(a, b)
+		lines = appendDiffLines(lines, a[:x], b[:y])
+		lines = appendDiffLines(lines, a[x:], b[y:])
+	}
+	for _, line := range suffix {
+		lines = append(lines, diffLine{' ', line})
+	}
+	return lines
+}
+
+// A point of a shortest edit script from a to b where both halves are shorter than the whole, a and b start and
+// end with different lines. The script is followed from both ends at once until the paths overlap, only the
+// furthest point reached on each diagonal is kept, forward in v and backward in w, -1 for the ones not reached.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	offset := max + 1
+	v, w := make([]int, 2*offset+1), make([]int, 2*offset+1)
+	for i := range v {
+		v[i], w[i] = -1, -1
+	}
+	v[offset+1], w[offset+1] = 0, 0
+	delta := n - m
+	// The paths meet in the forward step when delta is odd, in the backward one otherwise.
+	forward := delta%2 != 0
+	// The diagonals leaving the grid on each side are not followed any further.
+	vStart, vEnd, wStart, wEnd := 0, 0, 0, 0
+	for d := 0; d < max; d++ {
+		for k := -d + vStart; k <= d-vEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x > n {
+				vEnd += 2
+			} else if y > m {
+				vStart += 2
+			} else if c := offset + delta - k; forward && c >= 0 && c < len(w) && w[c] != -1 && x >= n-w[c] {
+				return x, y
+			}
+		}
+		for k := -d + wStart; k <= d-wEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && w[offset+k-1] < w[offset+k+1]) {
+				x = w[offset+k+1]
+			} else {
+				x = w[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x, y = x+1, y+1
+			}
+			w[offset+k] = x
+			if x > n {
+				wEnd += 2
+			} else if y > m {
+				wStart += 2
+			} else if c := offset + delta - k; !forward && c >= 0 && c < len(v) && v[c] != -1 && v[c] >= n-x {
+				return v[c], v[c] - (c - offset)
+			}
+		}
+	}
+	// Not reached for lines which start and end differently, the whole of a is replaced by b.
+	return n, 0
+}
+
+// You could get the unified diff between two texts, empty when they are the same.
+// 	diff := unifiedDiff("revision 1", "revision 2", from.text(), to.text())
+func unifiedDiff(fromName, toName, from, to string) string {
+	lines := diffLines(strings.Split(strings.TrimSuffix(from, "\n"), "\n"), strings.Split(strings.TrimSuffix(to, "\n"), "\n"))
+	var b strings.Builder
+	// Line numbers of lines[k] in from and in to.
+	fromLine, toLine := make([]int, len(lines)+1), make([]int, len(lines)+1)
+	for k, line := range lines {
+		fromLine[k+1], toLine[k+1] = fromLine[k], toLine[k]
+		if line.op != '+' {
+			fromLine[k+1]++
+		}
+		if line.op != '-' {
+			toLine[k+1]++
+		}
+	}
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+		// A hunk goes on while the changes are less than two contexts apart.
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(lines) {
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*diffContext {
+				break
+			}
+			for next < len(lines) && lines[next].op != ' ' {
+				next++
+			}
+			end = next
+		}
+		stop := end + diffContext
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(fromLine[start], fromLine[stop]), hunkRange(toLine[start], toLine[stop]))
+		for _, line := range lines[start:stop] {
+			fmt.Fprintf(&b, "%c%s\n", line.op, line.text)
+		}
+		k = stop
+	}
+	return b.String()
+}
+
+// The range of a hunk header from the number of lines before it and at its end, like "3,4" or "0,0".
+func hunkRange(before, after int) string {
+	count := after - before
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// You could get the unified diff from the revision number from to the revision number to of the article.
+// 	diff, err := articleModel.diffRevisions(1, 3)
+func (model ArticleModel) diffRevisions(from, to uint) (string, error) {
+	fromRevision, err := model.findRevision(from)
+	if err != nil {
+		return "", err
+	}
+	toRevision, err := model.findRevision(to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(fmt.Sprintf("revision %d", fromRevision.Number), fmt.Sprintf("revision %d", toRevision.Number),
+		fromRevision.text(), toRevision.text()), nil
+}
+
+// You could put the title, description and body of an old revision back, the slug follows the title.
+// It is saved as a new revision of the editor in the same transaction, the history itself is never rewritten.
+// 	err := articleModel.restoreRevision(revision, GetArticleUserModel(myUserModel))
+func (model *ArticleModel) restoreRevision(revision ArticleRevisionModel, editor ArticleUserModel) error {
+	previous := *model
+	return model.saveChange(func(tx *gorm.DB) error {
+		if err := model.setSlugFromTitle(tx, revision.Title); err != nil {
+			return err
+		}
+		err := tx.Model(model).Update(map[string]interface{}{
+			"title":       revision.Title,
+			"description": revision.Description,
+			"body":        revision.Body,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return model.addRevision(tx, previous, editor, revision.Number)
+	})
+}
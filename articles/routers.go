@@ -5,22 +5,30 @@ import (
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
 	router.POST("/", ArticleCreate)
 	router.PUT("/:slug", ArticleUpdate)
 	router.DELETE("/:slug", ArticleDelete)
+	router.POST("/:slug/cover", ArticleCoverUpload)
+	router.DELETE("/:slug/cover", ArticleCoverDelete)
 	router.POST("/:slug/favorite", ArticleFavorite)
 	router.DELETE("/:slug/favorite", ArticleUnfavorite)
 	router.POST("/:slug/comments", ArticleCommentCreate)
 	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.GET("/:slug/revisions", ArticleRevisionList)
+	router.GET("/:slug/revisions/diff", ArticleRevisionDiff)
+	router.POST("/:slug/revisions/:number/restore", ArticleRevisionRestore)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
 	router.GET("/", ArticleList)
+	router.GET("/search", ArticleSearch)
 	router.GET("/:slug", ArticleRetrieve)
 	router.GET("/:slug/comments", ArticleCommentList)
 }
@@ -37,7 +45,7 @@ func ArticleCreate(c *gin.Context) {
 	}
 	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
 
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
+	if err := articleModelValidator.articleModel.create(); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -52,15 +60,63 @@ func ArticleList(c *gin.Context) {
 	favorited := c.Query("favorited")
 	limit := c.Query("limit")
 	offset := c.Query("offset")
-	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited)
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	redirects := resolveUsernameFilters(&author, &favorited)
+	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited, myUserModel)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
 	serializer := ArticlesSerializer{c, articleModels}
+	if len(redirects) > 0 {
+		c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount, "redirect": redirects})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
 }
 
+// Links shared before a rename keep working, the hint returned tells the client the current usernames.
+func resolveUsernameFilters(author, favorited *string) map[string]*users.UsernameRedirect {
+	redirects := make(map[string]*users.UsernameRedirect)
+	for name, username := range map[string]*string{"author": author, "favorited": favorited} {
+		if *username == "" {
+			continue
+		}
+		if userModel, redirect, err := users.FindOneUserByUsername(*username); err == nil {
+			*username = userModel.Username
+			if redirect != nil {
+				redirects[name] = redirect
+			}
+		}
+	}
+	return redirects
+}
+
+// The articles matching ?q=, the most relevant first, with the filters of ArticleList.
+func ArticleSearch(c *gin.Context) {
+	q := c.Query("q")
+	if strings.TrimSpace(q) == "" {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: "q", Message: "{key: required}"}))
+		return
+	}
+	author := c.Query("author")
+	favorited := c.Query("favorited")
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	redirects := resolveUsernameFilters(&author, &favorited)
+	articleModels, results, modelCount, err := SearchArticles(q, c.Query("tag"), author, favorited,
+		c.Query("limit"), c.Query("offset"), myUserModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("search", err))
+		return
+	}
+	serializer := ArticleSearchSerializer{c, articleModels, results}
+	response := gin.H{"articles": serializer.Response(), "articlesCount": modelCount}
+	if len(redirects) > 0 {
+		response["redirect"] = redirects
+	}
+	c.JSON(http.StatusOK, response)
+}
+
 func ArticleFeed(c *gin.Context) {
 	limit := c.Query("limit")
 	offset := c.Query("offset")
@@ -86,7 +142,18 @@ func ArticleRetrieve(c *gin.Context) {
 		return
 	}
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if gorm.IsRecordNotFoundError(err) {
+		// The links to the article keep working after its title changed.
+		if articleModel, err := FindArticleBySlugHistory(slug); err == nil && articleModel.visibleTo(myUserModel) {
+			location := *c.Request.URL
+			location.Path = strings.TrimSuffix(location.Path, slug) + articleModel.Slug
+			// Not permanent, the title may change again and give the old slug back.
+			c.Redirect(http.StatusFound, location.String())
+			return
+		}
+	}
+	if err != nil || !articleModel.visibleTo(myUserModel) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
@@ -95,10 +162,8 @@ func ArticleRetrieve(c *gin.Context) {
 }
 
 func ArticleUpdate(c *gin.Context) {
-	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
-		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
 		return
 	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
@@ -107,8 +172,7 @@ func ArticleUpdate(c *gin.Context) {
 		return
 	}
 
-	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
+	if err := articleModel.edit(articleModelValidator.articleModel, articleModelValidator.articleModel.Author); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -116,24 +180,160 @@ func ArticleUpdate(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
+// Find the article of the slug parameter and check the current user may edit it, the response is written on failure.
+func findEditableArticle(c *gin.Context) (ArticleModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: c.Param("slug")})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return articleModel, false
+	}
+	if !articleModel.canBeEditedBy(myUserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("articles", errors.New("Not allowed to edit this article")))
+		return articleModel, false
+	}
+	return articleModel, true
+}
+
+func ArticleCoverUpload(c *gin.Context) {
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	// Leave some room for the multipart headers, the file itself is checked against CoverMaxSize.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, CoverMaxSize+64<<10)
+	file, _, err := c.Request.FormFile("cover")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: "Cover", Message: "{key: required}"}))
+		return
+	}
+	defer file.Close()
+	if err := articleModel.setCover(file); err != nil {
+		if _, ok := err.(common.FieldError); ok {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("storage", err))
+		}
+		return
+	}
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
+func ArticleCoverDelete(c *gin.Context) {
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	if err := articleModel.removeCover(); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("storage", err))
+		return
+	}
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
 func ArticleDelete(c *gin.Context) {
-	slug := c.Param("slug")
-	err := DeleteArticleModel(&ArticleModel{Slug: slug})
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	err := DeleteArticleModel(&ArticleModel{Slug: articleModel.Slug})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	users.RecordSecurityEvent(c, users.EventArticleDeleted, articleModel.Author.UserModel,
+		map[string]interface{}{"slug": articleModel.Slug, "title": articleModel.Title})
 	c.JSON(http.StatusOK, gin.H{"article": "Delete success"})
 }
 
+// The revisions are shown to the ones allowed to edit the article, they may hold what the author took out.
+func ArticleRevisionList(c *gin.Context) {
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	revisions, err := articleModel.getRevisions()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ArticleRevisionsSerializer{c, revisions}
+	c.JSON(http.StatusOK, gin.H{"revisions": serializer.Response(), "revisionsCount": len(revisions)})
+}
+
+// The unified diff between the revisions ?from= and ?to=, by default the latest one and the one before it.
+func ArticleRevisionDiff(c *gin.Context) {
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	var numbers [2]uint
+	for i, name := range []string{"from", "to"} {
+		if value := c.Query(name); value != "" {
+			number, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || number == 0 {
+				c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: name, Message: "{key: min}"}))
+				return
+			}
+			numbers[i] = uint(number)
+		}
+	}
+	if numbers[0] == 0 {
+		to, err := articleModel.findRevision(numbers[1])
+		if err != nil {
+			c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+			return
+		}
+		numbers = [2]uint{to.Number - 1, to.Number}
+		if numbers[0] == 0 {
+			numbers[0] = to.Number
+		}
+	}
+	diff, err := articleModel.diffRevisions(numbers[0], numbers[1])
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"diff": diff})
+}
+
+func ArticleRevisionRestore(c *gin.Context) {
+	articleModel, ok := findEditableArticle(c)
+	if !ok {
+		return
+	}
+	number, err := strconv.ParseUint(c.Param("number"), 10, 32)
+	var revision ArticleRevisionModel
+	if err == nil && number != 0 {
+		revision, err = articleModel.findRevision(uint(number))
+	}
+	if err != nil || number == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("revisions", errors.New("Invalid revision")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := articleModel.restoreRevision(revision, GetArticleUserModel(myUserModel)); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
 func ArticleFavorite(c *gin.Context) {
 	slug := c.Param("slug")
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !articleModel.visibleTo(myUserModel) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
-	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if users.IsBlockedBetween(myUserModel, articleModel.Author.UserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("articles", errors.New("You can't favorite this article")))
+		return
+	}
 	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
@@ -155,10 +355,15 @@ func ArticleUnfavorite(c *gin.Context) {
 func ArticleCommentCreate(c *gin.Context) {
 	slug := c.Param("slug")
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !articleModel.visibleTo(myUserModel) {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
 		return
 	}
+	if users.IsBlockedBetween(myUserModel, articleModel.Author.UserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("You can't comment on this article")))
+		return
+	}
 	commentModelValidator := NewCommentModelValidator()
 	if err := commentModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
@@ -175,28 +380,47 @@ func ArticleCommentCreate(c *gin.Context) {
 }
 
 func ArticleCommentDelete(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
 	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	id := uint(id64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	commentModel, err := FindOneComment("id = ? AND article_id = ?", id, articleModel.ID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
-	err = DeleteCommentModel([]uint{id})
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if !commentModel.canBeDeletedBy(articleModel, myUserModel) {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("You are not allowed to delete this comment")))
+		return
+	}
+	err = DeleteCommentModel("id = ? AND article_id = ?", commentModel.ID, articleModel.ID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
+	users.RecordSecurityEvent(c, users.EventCommentDeleted, commentModel.Author.UserModel,
+		map[string]interface{}{"slug": articleModel.Slug, "commentId": commentModel.ID})
 	c.JSON(http.StatusOK, gin.H{"comment": "Delete success"})
 }
 
 func ArticleCommentList(c *gin.Context) {
 	slug := c.Param("slug")
 	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err != nil || !articleModel.visibleTo(myUserModel) {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
-	err = articleModel.getComments()
+	err = articleModel.getComments(myUserModel)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
 		return
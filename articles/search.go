@@ -0,0 +1,355 @@
+package articles
+
+import (
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// An article found by a search, a higher Score is more relevant. Snippet is HTML: the escaped text around
+// the terms, which are wrapped in <mark>.
+type SearchResult struct {
+	ArticleID uint
+	Score     float64
+	Snippet   string
+}
+
+// A full-text search of the articles. Index and Remove keep it in sync with the articles, they are called in
+// the transaction of the change. Search only returns the articles of candidates, the query of their IDs.
+type SearchEngine interface {
+	Index(tx *gorm.DB, article ArticleModel) error
+	Remove(tx *gorm.DB, articleID uint) error
+	Search(terms []string, candidates *gorm.SqlExpr, limit, offset int) ([]SearchResult, int, error)
+}
+
+// The engine used by the articles, SetupSearch picks FTS5 when the SQLite driver has it.
+var DefaultSearchEngine SearchEngine = LikeSearchEngine{}
+
+// The weights of the columns in the relevance.
+const (
+	searchTitleWeight       = 10
+	searchDescriptionWeight = 5
+	searchBodyWeight        = 1
+	searchTagsWeight        = 3
+)
+
+// At most that many terms of a query are searched.
+const searchMaxTerms = 10
+
+// You could split a query in the terms searched, the punctuation is left out. All of them must match.
+// 	terms := searchTerms("Go, gin & gorm") // []string{"go", "gin", "gorm"}
+func searchTerms(query string) []string {
+	terms := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(terms) > searchMaxTerms {
+		terms = terms[:searchMaxTerms]
+	}
+	return terms
+}
+
+// The snippets are made with these markers around the terms, they are replaced once the text is escaped.
+const (
+	snippetStart    = "\x02"
+	snippetEnd      = "\x03"
+	snippetEllipsis = "…"
+)
+
+func snippetHTML(marked string) string {
+	escaped := html.EscapeString(marked)
+	return strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").Replace(escaped)
+}
+
+func articleTags(tx *gorm.DB, articleID uint) string {
+	var tags []string
+	tx.Table("article_tags").Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+		Where("article_tags.article_model_id = ?", articleID).Pluck("tag_models.tag", &tags)
+	return strings.Join(tags, " ")
+}
+
+// The SQLite FTS5 engine, its virtual table article_search holds the text of the articles with their IDs as rowid.
+// The driver has FTS5 when built with the sqlite_fts5 tag: go build -tags sqlite_fts5
+type FTS5SearchEngine struct{}
+
+func (FTS5SearchEngine) Index(tx *gorm.DB, article ArticleModel) error {
+	if err := tx.Exec("DELETE FROM article_search WHERE rowid = ?", article.ID).Error; err != nil {
+		return err
+	}
+	return tx.Exec("INSERT INTO article_search (rowid, title, description, body, tags) VALUES (?, ?, ?, ?, ?)",
+		article.ID, article.Title, article.Description, article.Body, articleTags(tx, article.ID)).Error
+}
+
+func (FTS5SearchEngine) Remove(tx *gorm.DB, articleID uint) error {
+	return tx.Exec("DELETE FROM article_search WHERE rowid = ?", articleID).Error
+}
+
+// The terms are quoted so they can't be taken for the FTS5 syntax, the last one also matches as a prefix.
+func fts5Query(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	return strings.Join(quoted, " ") + "*"
+}
+
+func (FTS5SearchEngine) Search(terms []string, candidates *gorm.SqlExpr, limit, offset int) ([]SearchResult, int, error) {
+	db := common.GetDB()
+	var results []SearchResult
+	var count int
+	if len(terms) == 0 {
+		return results, count, nil
+	}
+	match := fts5Query(terms)
+	err := db.Table("article_search").Where("article_search MATCH ? AND rowid IN (?)", match, candidates).Count(&count).Error
+	if err != nil || count == 0 {
+		return results, count, err
+	}
+	// bm25 gives the best matches the lowest scores.
+	rank := "bm25(article_search, " + strconv.Itoa(searchTitleWeight) + ", " + strconv.Itoa(searchDescriptionWeight) + ", " +
+		strconv.Itoa(searchBodyWeight) + ", " + strconv.Itoa(searchTagsWeight) + ")"
+	rows, err := db.Table("article_search").
+		Select("rowid, -"+rank+", snippet(article_search, -1, ?, ?, ?, 16)", snippetStart, snippetEnd, snippetEllipsis).
+		Where("article_search MATCH ? AND rowid IN (?)", match, candidates).
+		Order(rank + ", rowid DESC").Offset(offset).Limit(limit).Rows()
+	if err != nil {
+		return results, count, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var result SearchResult
+		var snippet string
+		if err := rows.Scan(&result.ArticleID, &result.Score, &snippet); err != nil {
+			return results, count, err
+		}
+		result.Snippet = snippetHTML(snippet)
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
+
+// The engine used without FTS5: the articles containing all the terms, ranked by the weighted count of the
+// columns they appear in. Nothing is indexed, it only suits small sites.
+type LikeSearchEngine struct{}
+
+func (LikeSearchEngine) Index(tx *gorm.DB, article ArticleModel) error {
+	return nil
+}
+
+func (LikeSearchEngine) Remove(tx *gorm.DB, articleID uint) error {
+	return nil
+}
+
+// How many matching articles are ranked at most.
+const likeSearchMaxMatches = 1000
+
+// Around how many characters of text the snippets show.
+const likeSnippetLength = 120
+
+func (LikeSearchEngine) Search(terms []string, candidates *gorm.SqlExpr, limit, offset int) ([]SearchResult, int, error) {
+	db := common.GetDB()
+	var results []SearchResult
+	if len(terms) == 0 {
+		return results, 0, nil
+	}
+	query := db.Model(&ArticleModel{}).Where("id IN (?)", candidates)
+	for _, term := range terms {
+		pattern := "%" + term + "%"
+		query = query.Where("LOWER(title) LIKE ? OR LOWER(description) LIKE ? OR LOWER(body) LIKE ? OR id IN (?)",
+			pattern, pattern, pattern, db.Table("article_tags").Select("article_tags.article_model_id").
+				Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+				Where("LOWER(tag_models.tag) LIKE ?", pattern).QueryExpr())
+	}
+	var articleModels []ArticleModel
+	if err := query.Order("id DESC").Limit(likeSearchMaxMatches).Find(&articleModels).Error; err != nil {
+		return results, 0, err
+	}
+	for _, articleModel := range articleModels {
+		tags := strings.ToLower(articleTags(db, articleModel.ID))
+		result := SearchResult{ArticleID: articleModel.ID}
+		for _, term := range terms {
+			for _, column := range []struct {
+				text   string
+				weight int
+			}{
+				{strings.ToLower(articleModel.Title), searchTitleWeight},
+				{strings.ToLower(articleModel.Description), searchDescriptionWeight},
+				{strings.ToLower(articleModel.Body), searchBodyWeight},
+				{tags, searchTagsWeight},
+			} {
+				result.Score += float64(strings.Count(column.text, term) * column.weight)
+			}
+		}
+		for _, text := range []string{articleModel.Body, articleModel.Description, articleModel.Title} {
+			if snippet := likeSnippet(text, terms); snippet != "" {
+				result.Snippet = snippet
+				break
+			}
+		}
+		results = append(results, result)
+	}
+	// The order by id above breaks the ties, the most recent first.
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	count := len(results)
+	if offset >= count {
+		return nil, count, nil
+	}
+	if offset+limit < count {
+		results = results[offset : offset+limit]
+	} else {
+		results = results[offset:]
+	}
+	return results, count, nil
+}
+
+// The text around the first term found in it with the terms marked, empty when there is none.
+func likeSnippet(text string, terms []string) string {
+	runes := []rune(text)
+	// The length of the term found at i, the longest one when several are.
+	matchAt := func(i int) int {
+		n := 0
+		for _, term := range terms {
+			length := len([]rune(term))
+			if length > n && i+length <= len(runes) && strings.ToLower(string(runes[i:i+length])) == term {
+				n = length
+			}
+		}
+		return n
+	}
+	first := -1
+	for i := range runes {
+		if matchAt(i) > 0 {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	start := first - likeSnippetLength/3
+	if start < 0 {
+		start = 0
+	}
+	end := start + likeSnippetLength
+	if end > len(runes) {
+		end = len(runes)
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString(snippetEllipsis)
+	}
+	for i := start; i < end; {
+		if n := matchAt(i); n > 0 {
+			b.WriteString(snippetStart + string(runes[i:i+n]) + snippetEnd)
+			i += n
+			continue
+		}
+		b.WriteRune(runes[i])
+		i++
+	}
+	if end < len(runes) {
+		b.WriteString(snippetEllipsis)
+	}
+	return snippetHTML(b.String())
+}
+
+// You could choose the search engine once the articles are migrated: FTS5 when the SQLite driver has it,
+// filled with the existing articles when its table is new. The other databases keep LikeSearchEngine.
+// 	articles.SetupSearch(db)
+func SetupSearch(db *gorm.DB) error {
+	if db.Dialect().GetName() != "sqlite3" {
+		return nil
+	}
+	exists := db.Dialect().HasTable("article_search")
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS article_search USING fts5(" +
+		"title, description, body, tags, tokenize = 'unicode61 remove_diacritics 2')").Error
+	if err != nil {
+		log.Printf("search: FTS5 is not available, falling back to LIKE: %v", err)
+		return nil
+	}
+	DefaultSearchEngine = FTS5SearchEngine{}
+	if exists {
+		return nil
+	}
+	var articleModels []ArticleModel
+	if err := db.Find(&articleModels).Error; err != nil {
+		return err
+	}
+	tx := db.Begin()
+	for _, articleModel := range articleModels {
+		if err := DefaultSearchEngine.Index(tx, articleModel); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Keep the search in sync whatever the way the article is saved, the batch updates without an ID don't
+// change the text.
+func (model *ArticleModel) AfterSave(tx *gorm.DB) error {
+	if model.ID == 0 {
+		return nil
+	}
+	var articleModel ArticleModel
+	if err := tx.First(&articleModel, model.ID).Error; err != nil {
+		return err
+	}
+	return DefaultSearchEngine.Index(tx, articleModel)
+}
+
+// You could search the articles the viewer can see, filtered like ArticleList, the most relevant first.
+// The results are in the order of the articles.
+// 	articleModels, results, count, err := SearchArticles("gin gorm", "golang", "", "", "20", "0", myUserModel)
+func SearchArticles(q, tag, author, favorited, limit, offset string, viewer users.UserModel) ([]ArticleModel, []SearchResult, int, error) {
+	db := common.GetDB()
+	var models []ArticleModel
+	offset_int, err := strconv.Atoi(offset)
+	if err != nil || offset_int < 0 {
+		offset_int = 0
+	}
+	limit_int, err := strconv.Atoi(limit)
+	if err != nil || limit_int <= 0 {
+		limit_int = 20
+	}
+
+	tx := db.Begin()
+	query, ok := filteredArticles(tx, tag, author, favorited, viewer)
+	if !ok {
+		return models, nil, 0, tx.Commit().Error
+	}
+	candidates := query.Select("article_models.id").QueryExpr()
+	tx.Commit()
+	results, count, err := DefaultSearchEngine.Search(searchTerms(q), candidates, limit_int, offset_int)
+	if err != nil {
+		return models, nil, count, err
+	}
+	ids := make([]uint, len(results))
+	for i, result := range results {
+		ids[i] = result.ArticleID
+	}
+	var found []ArticleModel
+	err = db.Preload("Author").Preload("Author.UserModel").Preload("Tags").Where("id IN (?)", ids).Find(&found).Error
+	if err != nil {
+		return models, nil, count, err
+	}
+	byID := make(map[uint]ArticleModel, len(found))
+	for _, articleModel := range found {
+		byID[articleModel.ID] = articleModel
+	}
+	// The articles keep the order of the results, an article deleted since it was indexed is left out with its result.
+	var kept []SearchResult
+	for _, result := range results {
+		if articleModel, ok := byID[result.ArticleID]; ok {
+			models = append(models, articleModel)
+			kept = append(kept, result)
+		}
+	}
+	return models, kept, count, nil
+}
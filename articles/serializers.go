@@ -1,9 +1,9 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 type TagSerializer struct {
@@ -34,7 +34,13 @@ type ArticleUserSerializer struct {
 	ArticleUserModel
 }
 
+// The username shown for the articles and comments of deleted accounts.
+const DeletedUsername = "[deleted]"
+
 func (s *ArticleUserSerializer) Response() users.ProfileResponse {
+	if s.ArticleUserModel.UserModelID == 0 {
+		return users.ProfileResponse{Username: DeletedUsername, SocialLinks: []string{}}
+	}
 	response := users.ProfileSerializer{s.C, s.ArticleUserModel.UserModel}
 	return response.Response()
 }
@@ -50,12 +56,17 @@ type ArticleResponse struct {
 	Slug           string                `json:"slug"`
 	Description    string                `json:"description"`
 	Body           string                `json:"body"`
+	BodyHTML       string                `json:"bodyHtml"`
+	CoverImage     *string               `json:"coverImage"`
 	CreatedAt      string                `json:"createdAt"`
 	UpdatedAt      string                `json:"updatedAt"`
 	Author         users.ProfileResponse `json:"author"`
 	Tags           []string              `json:"tagList"`
 	Favorite       bool                  `json:"favorited"`
 	FavoritesCount uint                  `json:"favoritesCount"`
+	Status         string                `json:"status"`
+	PublishAt      *string               `json:"publishAt"`
+	PublishedAt    *string               `json:"publishedAt"`
 }
 
 type ArticlesSerializer struct {
@@ -68,16 +79,21 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
 	response := ArticleResponse{
 		ID:          s.ID,
-		Slug:        slug.Make(s.Title),
+		Slug:        s.Slug,
 		Title:       s.Title,
 		Description: s.Description,
 		Body:        s.Body,
+		BodyHTML:    s.bodyHTML(),
+		CoverImage:  s.coverURL(),
 		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:         authorSerializer.Response(),
 		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
 		FavoritesCount: s.favoritesCount(),
+		Status:         s.Status,
+		PublishAt:      articleTime(s.PublishAt),
+		PublishedAt:    articleTime(s.PublishedAt),
 	}
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
@@ -87,7 +103,49 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 	return response
 }
 
+// The HTML of the body preloaded by preloadBodies, or that of this article alone when it isn't part of a page.
+func (s *ArticleSerializer) bodyHTML() string {
+	if preloaded, ok := s.C.Get("article_bodies"); ok {
+		if bodyHTML, ok := preloaded.(map[uint]string)[s.ID]; ok {
+			return bodyHTML
+		}
+	}
+	return loadBodiesHTML([]ArticleModel{s.ArticleModel})[s.ID]
+}
+
+// The HTML of the bodies of a page, loaded at once by loadBodiesHTML.
+func preloadBodies(c *gin.Context, articles []ArticleModel) {
+	c.Set("article_bodies", loadBodiesHTML(articles))
+}
+
+func articleTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	formatted := t.UTC().Format("2006-01-02T15:04:05.999Z")
+	return &formatted
+}
+
+// The profiles of the authors of a page, loaded at once by users.PreloadProfiles.
+func preloadAuthors(c *gin.Context, authors []ArticleUserModel) {
+	var userModels []users.UserModel
+	for _, author := range authors {
+		userModels = append(userModels, author.UserModel)
+	}
+	users.PreloadProfiles(c, userModels)
+}
+
+func articleAuthors(articles []ArticleModel) []ArticleUserModel {
+	var authors []ArticleUserModel
+	for _, article := range articles {
+		authors = append(authors, article.Author)
+	}
+	return authors
+}
+
 func (s *ArticlesSerializer) Response() []ArticleResponse {
+	preloadAuthors(s.C, articleAuthors(s.Articles))
+	preloadBodies(s.C, s.Articles)
 	response := []ArticleResponse{}
 	for _, article := range s.Articles {
 		serializer := ArticleSerializer{s.C, article}
@@ -96,6 +154,28 @@ func (s *ArticlesSerializer) Response() []ArticleResponse {
 	return response
 }
 
+type ArticleSearchSerializer struct {
+	C        *gin.Context
+	Articles []ArticleModel
+	Results  []SearchResult
+}
+
+type ArticleSearchResponse struct {
+	ArticleResponse
+	Snippet string `json:"snippet"`
+}
+
+func (s *ArticleSearchSerializer) Response() []ArticleSearchResponse {
+	preloadAuthors(s.C, articleAuthors(s.Articles))
+	preloadBodies(s.C, s.Articles)
+	response := []ArticleSearchResponse{}
+	for i, article := range s.Articles {
+		serializer := ArticleSerializer{s.C, article}
+		response = append(response, ArticleSearchResponse{serializer.Response(), s.Results[i].Snippet})
+	}
+	return response
+}
+
 type CommentSerializer struct {
 	C *gin.Context
 	CommentModel
@@ -109,6 +189,7 @@ type CommentsSerializer struct {
 type CommentResponse struct {
 	ID        uint                  `json:"id"`
 	Body      string                `json:"body"`
+	BodyHTML  string                `json:"bodyHtml"`
 	CreatedAt string                `json:"createdAt"`
 	UpdatedAt string                `json:"updatedAt"`
 	Author    users.ProfileResponse `json:"author"`
@@ -119,6 +200,7 @@ func (s *CommentSerializer) Response() CommentResponse {
 	response := CommentResponse{
 		ID:        s.ID,
 		Body:      s.Body,
+		BodyHTML:  s.bodyHTML(),
 		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:    authorSerializer.Response(),
@@ -127,6 +209,11 @@ func (s *CommentSerializer) Response() CommentResponse {
 }
 
 func (s *CommentsSerializer) Response() []CommentResponse {
+	var authors []ArticleUserModel
+	for _, comment := range s.Comments {
+		authors = append(authors, comment.Author)
+	}
+	preloadAuthors(s.C, authors)
 	response := []CommentResponse{}
 	for _, comment := range s.Comments {
 		serializer := CommentSerializer{s.C, comment}
@@ -134,3 +221,48 @@ func (s *CommentsSerializer) Response() []CommentResponse {
 	}
 	return response
 }
+
+type ArticleRevisionSerializer struct {
+	C *gin.Context
+	ArticleRevisionModel
+}
+
+type ArticleRevisionsSerializer struct {
+	C         *gin.Context
+	Revisions []ArticleRevisionModel
+}
+
+type ArticleRevisionResponse struct {
+	Number       uint                  `json:"number"`
+	Title        string                `json:"title"`
+	Description  string                `json:"description"`
+	Body         string                `json:"body"`
+	Editor       users.ProfileResponse `json:"editor"`
+	RestoredFrom *uint                 `json:"restoredFrom"`
+	CreatedAt    string                `json:"createdAt"`
+}
+
+func (s *ArticleRevisionSerializer) Response() ArticleRevisionResponse {
+	editorSerializer := ArticleUserSerializer{s.C, s.Editor}
+	response := ArticleRevisionResponse{
+		Number:      s.Number,
+		Title:       s.Title,
+		Description: s.Description,
+		Body:        s.Body,
+		Editor:      editorSerializer.Response(),
+		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	if s.RestoredFrom != 0 {
+		response.RestoredFrom = &s.RestoredFrom
+	}
+	return response
+}
+
+func (s *ArticleRevisionsSerializer) Response() []ArticleRevisionResponse {
+	response := []ArticleRevisionResponse{}
+	for _, revision := range s.Revisions {
+		serializer := ArticleRevisionSerializer{s.C, revision}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
@@ -0,0 +1,165 @@
+package articles
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gosimple/slug"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// A slug an article had before its title changed, ArticleRetrieve redirects from it to the current one.
+// An old slug stays with its article, another article never takes it.
+type ArticleSlugModel struct {
+	gorm.Model
+	Slug      string `gorm:"unique_index"`
+	Article   ArticleModel
+	ArticleID uint `gorm:"index"`
+}
+
+// The slugs matching another route of /articles, an article with such a title gets a suffix.
+var reservedSlugs = map[string]bool{
+	"feed":   true,
+	"search": true,
+}
+
+// The slug of a title made only of punctuation.
+const defaultSlug = "article"
+
+var slugSuffix = regexp.MustCompile(`-[0-9]+$`)
+
+func titleSlug(title string) string {
+	if s := slug.Make(title); s != "" {
+		return s
+	}
+	return defaultSlug
+}
+
+// You could get a free slug for the title of the article articleID (0 for a new one): the slug of the title,
+// followed by the next suffix, "-2", "-3"..., when it is used by another article as current slug, even deleted,
+// or as an old one. The slugs using the suffixes are read at once, the unique indexes still refuse a slug
+// another request took in the meantime.
+// 	s, err := uniqueSlug(db, "How to train your dragon", 0)
+func uniqueSlug(tx *gorm.DB, title string, articleID uint) (string, error) {
+	base := titleSlug(title)
+	rows, err := tx.Raw("SELECT slug FROM article_models WHERE (slug = ? OR slug LIKE ?) AND id <> ? "+
+		"UNION SELECT slug FROM article_slug_models WHERE (slug = ? OR slug LIKE ?) AND article_id <> ?",
+		base, base+"-%", articleID, base, base+"-%", articleID).Rows()
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	taken := reservedSlugs[base]
+	last := 1
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return "", err
+		}
+		if s == base {
+			taken = true
+			continue
+		}
+		// The LIKE pattern also matches the slugs of longer titles, like "top-ten" for "top".
+		if n, err := strconv.Atoi(strings.TrimPrefix(s, base+"-")); err == nil && n > last {
+			last = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if !taken {
+		return base, nil
+	}
+	return base + "-" + strconv.Itoa(last+1), nil
+}
+
+// How many times a change is tried again when another request took its slug or revision number in the meantime.
+const slugAttempts = 3
+
+// You could save a change of the article in one transaction, tried again from the same state of the article when
+// another request took a slug or revision number it uses.
+// 	err := articleModel.saveChange(func(tx *gorm.DB) error { return articleModel.setSlugFromTitle(tx, title) })
+func (model *ArticleModel) saveChange(change func(tx *gorm.DB) error) error {
+	db := common.GetDB()
+	saved := *model
+	var err error
+	for attempt := 0; attempt < slugAttempts; attempt++ {
+		tx := db.Begin()
+		if err = change(tx); err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+		if err == nil {
+			return nil
+		}
+		*model = saved
+		if !common.IsUniqueViolation(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// You could save a new article with a free slug made from its title, and its first revision.
+// 	err := articleModel.create()
+func (model *ArticleModel) create() error {
+	return model.saveChange(func(tx *gorm.DB) error {
+		var err error
+		if model.Slug, err = uniqueSlug(tx, model.Title, 0); err != nil {
+			return err
+		}
+		if err := tx.Save(model).Error; err != nil {
+			return err
+		}
+		return model.addRevision(tx, ArticleModel{}, model.Author, 0)
+	})
+}
+
+// You could give the article the slug of its new title, the previous slug is kept in the history so the
+// links to it still work. Nothing changes when the title gives the same slug, or the same slug before the
+// suffix the current one got as a duplicate: "top-2" stays for "Top!" but "top-10" of "Top 10" goes for "Top".
+// 	err := articleModel.setSlugFromTitle(tx, "A new title")
+func (model *ArticleModel) setSlugFromTitle(tx *gorm.DB, title string) error {
+	base := titleSlug(title)
+	if model.Slug == base || model.isDuplicateOf(base) {
+		return nil
+	}
+	previous := model.Slug
+	s, err := uniqueSlug(tx, title, model.ID)
+	if err != nil || s == previous {
+		return err
+	}
+	// Going back to an old slug takes it out of the history.
+	if err := tx.Unscoped().Where("slug = ? AND article_id = ?", s, model.ID).Delete(ArticleSlugModel{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(model).Update("slug", s).Error; err != nil {
+		return err
+	}
+	return tx.Create(&ArticleSlugModel{Slug: previous, ArticleID: model.ID}).Error
+}
+
+// Whether the slug of the article is base with the suffix of a duplicate, a suffix which is part of the slug of
+// the title does not count.
+func (model *ArticleModel) isDuplicateOf(base string) bool {
+	return model.Slug != titleSlug(model.Title) && slugSuffix.MatchString(model.Slug) &&
+		slugSuffix.ReplaceAllString(model.Slug, "") == base
+}
+
+// You could find the article which used to have the slug, gorm.ErrRecordNotFound when there is none.
+// 	articleModel, err := FindArticleBySlugHistory("old-title")
+func FindArticleBySlugHistory(s string) (ArticleModel, error) {
+	db := common.GetDB()
+	var slugModel ArticleSlugModel
+	if s == "" {
+		return ArticleModel{}, gorm.ErrRecordNotFound
+	}
+	if err := db.Where(ArticleSlugModel{Slug: s}).First(&slugModel).Error; err != nil {
+		return ArticleModel{}, err
+	}
+	return FindOneArticle(&ArticleModel{Model: gorm.Model{ID: slugModel.ArticleID}})
+}
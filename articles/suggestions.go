@@ -0,0 +1,108 @@
+package articles
+
+import (
+	"fmt"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// SuggestFavoritedAuthors is a users.SuggestionSource: the authors of the articles the user favorited.
+// 	users.RegisterSuggestionSource(articles.SuggestFavoritedAuthors)
+func SuggestFavoritedAuthors(userModel users.UserModel, limit int) ([]users.Suggestion, error) {
+	db := common.GetDB()
+	rows, err := db.Table("favorite_models").Select("authors.user_model_id, COUNT(*)").
+		Joins("JOIN article_user_models AS fans ON fans.id = favorite_models.favorite_by_id").
+		Joins("JOIN article_models ON article_models.id = favorite_models.favorite_id AND article_models.deleted_at IS NULL "+
+			"AND article_models.status = ?", ArticlePublished).
+		Joins("JOIN article_user_models AS authors ON authors.id = article_models.author_id").
+		Where("fans.user_model_id = ? AND favorite_models.deleted_at IS NULL", userModel.ID).
+		Group("authors.user_model_id").Order("COUNT(*) DESC, authors.user_model_id").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []users.Suggestion
+	for rows.Next() {
+		var id uint
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		reason := "Wrote an article you favorited"
+		if count > 1 {
+			reason = fmt.Sprintf("Wrote %d articles you favorited", count)
+		}
+		suggestions = append(suggestions, users.Suggestion{UserID: id, Score: 2 * count, Reason: reason})
+	}
+	return suggestions, rows.Err()
+}
+
+// SuggestTagAuthors is a users.SuggestionSource: the authors writing in the tags of the articles
+// the user favorited or wrote, the reason names the tag they use the most.
+// 	users.RegisterSuggestionSource(articles.SuggestTagAuthors)
+func SuggestTagAuthors(userModel users.UserModel, limit int) ([]users.Suggestion, error) {
+	db := common.GetDB()
+	favorited := db.Table("favorite_models").Select("favorite_models.favorite_id").
+		Joins("JOIN article_user_models ON article_user_models.id = favorite_models.favorite_by_id").
+		Where("article_user_models.user_model_id = ? AND favorite_models.deleted_at IS NULL", userModel.ID).QueryExpr()
+	tagIDs := db.Table("article_tags").Select("article_tags.tag_model_id").
+		Joins("JOIN article_models ON article_models.id = article_tags.article_model_id AND article_models.deleted_at IS NULL").
+		Joins("JOIN article_user_models ON article_user_models.id = article_models.author_id").
+		Where("article_user_models.user_model_id = ? OR article_models.id IN (?)", userModel.ID, favorited).QueryExpr()
+	tagged := func() *gorm.DB {
+		query := db.Table("article_tags").
+			Joins("JOIN article_models ON article_models.id = article_tags.article_model_id AND article_models.deleted_at IS NULL "+
+				"AND article_models.status = ?", ArticlePublished).
+			Joins("JOIN article_user_models ON article_user_models.id = article_models.author_id").
+			Where("article_tags.tag_model_id IN (?)", tagIDs)
+		return withoutPrivateAuthors(query, userModel)
+	}
+
+	// The best scored authors first, then the tag each of them uses the most.
+	rows, err := tagged().Select("article_user_models.user_model_id, COUNT(*)").
+		Group("article_user_models.user_model_id").Order("COUNT(*) DESC, article_user_models.user_model_id").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	var suggestions []users.Suggestion
+	var ids []uint
+	index := make(map[uint]int)
+	for rows.Next() {
+		var id uint
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[id] = len(suggestions)
+		ids = append(ids, id)
+		suggestions = append(suggestions, users.Suggestion{UserID: id, Score: count})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return suggestions, err
+	}
+
+	rows, err = tagged().Select("article_user_models.user_model_id, tag_models.tag").
+		Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+		Where("article_user_models.user_model_id IN (?)", ids).
+		Group("article_user_models.user_model_id, tag_models.tag").Order("COUNT(*) DESC, tag_models.tag").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uint
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		if suggestion := &suggestions[index[id]]; suggestion.Reason == "" {
+			suggestion.Reason = fmt.Sprintf("Writes about %s", tag)
+		}
+	}
+	return suggestions, rows.Err()
+}
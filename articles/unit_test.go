@@ -0,0 +1,644 @@
+package articles
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/stretchr/testify/assert"
+)
+
+var test_db *gorm.DB
+
+func userModelMocker(n int) []users.UserModel {
+	// Numbered after the last user rather than counted, accounts get deleted by the tests.
+	var last users.UserModel
+	test_db.Order("id desc").First(&last)
+	offset := int(last.ID)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username:     fmt.Sprintf("author%v", i),
+			Email:        fmt.Sprintf("author%v@linkedin.com", i),
+			Bio:          fmt.Sprintf("bio%v", i),
+			PasswordHash: "password123",
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func articleModelMocker(author users.UserModel, title string) ArticleModel {
+	articleModel := ArticleModel{
+		Title:       title,
+		Description: "description of " + title,
+		Body:        "body of " + title,
+		Author:      GetArticleUserModel(author),
+		Status:      ArticlePublished,
+	}
+	articleModel.create()
+	return articleModel
+}
+
+func commentModelMocker(articleModel ArticleModel, author users.UserModel, body string) CommentModel {
+	commentModel := CommentModel{Article: articleModel, Author: GetArticleUserModel(author), Body: body}
+	SaveOne(&commentModel)
+	return commentModel
+}
+
+// The routes of hello.go, the requests are made as the user asUser, 0 being anonymous.
+func articlesRouter() func(method, url string, asUser uint) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ArticlesAnonymousRegister(r.Group("/api/articles"))
+	r.Use(users.AuthMiddleware(true))
+	ArticlesRegister(r.Group("/api/articles"))
+	return func(method, url string, asUser uint) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		if asUser != 0 {
+			req.Header.Set("Authorization", "Token "+common.GenToken(asUser))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+}
+
+func TestCommentDelete(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(4)
+	author, commenter, moderator, stranger := mocks[0], mocks[1], mocks[2], mocks[3]
+	asserts.NoError(test_db.Model(&moderator).Update("role", users.RoleModerator).Error, "role should be set")
+	moderator, _ = users.FindOneUser(&users.UserModel{ID: moderator.ID})
+	asserts.True(moderator.IsModerator(), "role should be set")
+	articleModel := articleModelMocker(author, "Comment deletion")
+	otherArticleModel := articleModelMocker(stranger, "Other comments")
+	first := commentModelMocker(articleModel, commenter, "first")
+	second := commentModelMocker(articleModel, commenter, "second")
+	other := commentModelMocker(otherArticleModel, commenter, "other")
+	request := articlesRouter()
+	url := func(articleModel ArticleModel, id uint) string {
+		return fmt.Sprintf("/api/articles/%v/comments/%v", articleModel.Slug, id)
+	}
+
+	_, err := FindOneComment("id = ? AND article_id = ?", 0, articleModel.ID)
+	asserts.Error(err, "comment 0 should not be found")
+	asserts.Equal(http.StatusNotFound, request("DELETE", url(articleModel, 0), author.ID).Code, "comment 0 should not be found")
+	asserts.Equal(http.StatusNotFound, request("DELETE", url(articleModel, other.ID), moderator.ID).Code,
+		"comment of another article should not be found")
+	asserts.Equal(http.StatusForbidden, request("DELETE", url(articleModel, first.ID), stranger.ID).Code,
+		"other users should not delete the comment")
+	_, err = FindOneComment("id = ? AND article_id = ?", first.ID, articleModel.ID)
+	asserts.NoError(err, "comment should still exist")
+
+	asserts.Equal(http.StatusOK, request("DELETE", url(articleModel, first.ID), moderator.ID).Code, "moderator should delete the comment")
+	_, err = FindOneComment("id = ? AND article_id = ?", first.ID, articleModel.ID)
+	asserts.Error(err, "comment should be deleted")
+	asserts.Equal(http.StatusOK, request("DELETE", url(articleModel, second.ID), author.ID).Code, "author of the article should delete the comment")
+	asserts.Equal(http.StatusOK, request("DELETE", url(otherArticleModel, other.ID), commenter.ID).Code, "author of the comment should delete it")
+
+	events, count, _ := users.FindSecurityEvents(users.SecurityEventFilter{UserModelID: commenter.ID, ActorID: moderator.ID, Type: users.EventCommentDeleted}, 20, 0)
+	asserts.Equal(1, count, "moderator deletion should be audited")
+	asserts.Contains(events[0].Details, articleModel.Slug, "moderator deletion should be audited")
+}
+
+func TestDeleteUserContent(t *testing.T) {
+	asserts := assert.New(t)
+
+	root, _ := ioutil.TempDir("", "media")
+	defer os.RemoveAll(root)
+	defer func(storage common.Storage) { common.MediaStorage = storage }(common.MediaStorage)
+	common.MediaStorage = common.NewLocalStorage(root, "http://localhost:8080/media", []byte("secret"))
+	defer func(mode string) { DeletedUserContent = mode }(DeletedUserContent)
+	stored := func(key string) bool {
+		file, err := common.MediaStorage.Get(key)
+		if err == nil {
+			file.Close()
+		}
+		return err == nil
+	}
+
+	for _, mode := range []string{DeletedUserContentAnonymize, DeletedUserContentDelete} {
+		DeletedUserContent = mode
+		mocks := userModelMocker(2)
+		leaving, staying := mocks[0], mocks[1]
+		own := articleModelMocker(leaving, "Leaving in "+mode)
+		own.CoverKey = "covers/" + mode + ".jpg"
+		common.MediaStorage.Put(own.CoverKey, strings.NewReader("cover"), "image/jpeg")
+		test_db.Model(&own).UpdateColumn("cover_key", own.CoverKey)
+		others := articleModelMocker(staying, "Staying in "+mode)
+		commentModelMocker(own, staying, "on the leaving article")
+		comment := commentModelMocker(others, leaving, "by the leaving user")
+		asserts.NoError(others.favoriteBy(GetArticleUserModel(leaving)), "favorite should be saved")
+
+		asserts.NoError(users.DeleteAccount(leaving), "account should be deleted in "+mode+" mode")
+		asserts.Equal(uint(0), others.favoritesCount(), "favorites of the user should be removed in "+mode+" mode")
+		var count int
+		test_db.Model(&ArticleUserModel{}).Where("user_model_id = ?", leaving.ID).Count(&count)
+		asserts.Equal(0, count, "article user should be removed in "+mode+" mode")
+		_, err := FindOneArticle(&ArticleModel{Slug: others.Slug})
+		asserts.NoError(err, "articles of the others should be kept in "+mode+" mode")
+
+		article, articleErr := FindOneArticle(&ArticleModel{Slug: own.Slug})
+		commentModel, commentErr := FindOneComment("id = ?", comment.ID)
+		if mode == DeletedUserContentAnonymize {
+			deleted, _ := getDeletedArticleUserModel(test_db)
+			asserts.NoError(articleErr, "articles should be kept when anonymizing")
+			asserts.Equal(deleted.ID, article.AuthorID, "articles should belong to the placeholder author")
+			asserts.NoError(commentErr, "comments should be kept when anonymizing")
+			asserts.Equal(deleted.ID, commentModel.AuthorID, "comments should belong to the placeholder author")
+			asserts.True(stored(own.CoverKey), "covers should be kept when anonymizing")
+		} else {
+			asserts.Error(articleErr, "articles should be deleted")
+			asserts.Error(commentErr, "comments should be deleted")
+			test_db.Model(&CommentModel{}).Where("article_id = ?", own.ID).Count(&count)
+			asserts.Equal(0, count, "comments on the deleted articles should be deleted")
+			test_db.Model(&ArticleRevisionModel{}).Where("article_id = ?", own.ID).Count(&count)
+			asserts.Equal(0, count, "revisions of the deleted articles should be deleted")
+			asserts.False(stored(own.CoverKey), "covers should be removed after the commit")
+		}
+	}
+}
+
+func TestArticleDeleteCover(t *testing.T) {
+	asserts := assert.New(t)
+	defer func(storage common.Storage) { common.MediaStorage = storage }(common.MediaStorage)
+	common.MediaStorage = common.NewLocalStorage(t.TempDir(), "http://localhost:8080/media", []byte("secret"))
+
+	author := userModelMocker(1)[0]
+	articleModel := articleModelMocker(author, "Deleted with its cover")
+	articleModel.CoverKey = fmt.Sprintf("covers/%d/deleted.jpg", articleModel.ID)
+	common.MediaStorage.Put(articleModel.CoverKey, strings.NewReader("cover"), "image/jpeg")
+	test_db.Model(&articleModel).UpdateColumn("cover_key", articleModel.CoverKey)
+
+	request := articlesRouter()
+	asserts.Equal(http.StatusOK, request("DELETE", "/api/articles/"+articleModel.Slug, author.ID).Code, "the author should delete the article")
+	_, err := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	asserts.Error(err, "the article should be deleted")
+	_, err = common.MediaStorage.Get(articleModel.CoverKey)
+	asserts.Error(err, "the cover file should be removed with the article")
+}
+
+func TestExportUserContent(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(2)
+	userModel, other := mocks[0], mocks[1]
+	own := articleModelMocker(userModel, "Exported article")
+	deleted := articleModelMocker(other, "Deleted before the export")
+	commentModelMocker(deleted, userModel, "comment on a deleted article")
+	own.favoriteBy(GetArticleUserModel(userModel))
+	test_db.Delete(&deleted)
+
+	files, err := ExportUserContent(userModel)
+	asserts.NoError(err, "a comment on a deleted article should not fail the export")
+	asserts.Contains(string(files["articles.json"]), own.Slug, "the articles should be exported")
+	asserts.Contains(string(files["comments.json"]), "comment on a deleted article", "the comments should be exported")
+	asserts.Contains(string(files["favorites.json"]), own.Slug, "the favorites should be exported")
+
+	asserts.NoError(test_db.Exec("ALTER TABLE favorite_models RENAME TO favorite_models_moved").Error)
+	_, err = ExportUserContent(userModel)
+	asserts.NoError(test_db.Exec("ALTER TABLE favorite_models_moved RENAME TO favorite_models").Error)
+	asserts.Error(err, "a database error should fail the export rather than leave the favorites out")
+}
+
+func TestSuggestTagAuthors(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(3)
+	reader, prolific, occasional := mocks[0], mocks[1], mocks[2]
+	tagged := func(author users.UserModel, title string, tags ...string) {
+		articleModel := ArticleModel{Title: title, Body: title, Author: GetArticleUserModel(author), Status: ArticlePublished}
+		articleModel.setTags(tags)
+		asserts.NoError(articleModel.create())
+	}
+	tagged(reader, "Reading suggestions", "suggestedtag")
+	tagged(prolific, "Prolific one", "suggestedtag", "othertag")
+	tagged(prolific, "Prolific two", "suggestedtag")
+	tagged(prolific, "Prolific three", "othertag")
+	tagged(occasional, "Occasional one", "suggestedtag")
+
+	suggestions, err := SuggestTagAuthors(reader, 1)
+	asserts.NoError(err)
+	asserts.Len(suggestions, 1, "the suggestions should be limited")
+	asserts.Equal(prolific.ID, suggestions[0].UserID, "the author writing the most in the tags should come first")
+	asserts.Equal(2, suggestions[0].Score, "only the tags of the user should count")
+	asserts.Equal("Writes about suggestedtag", suggestions[0].Reason, "the reason should name the tag")
+	suggestions, _ = SuggestTagAuthors(reader, 10)
+	asserts.Len(suggestions, 3, "every author of the tags should be suggested within the limit")
+}
+
+func TestBlockedAndMutedAuthors(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(4)
+	viewer, blocked, blocker, muted := mocks[0], mocks[1], mocks[2], mocks[3]
+	test_db.Create(&users.BlockModel{BlockerID: viewer.ID, BlockedID: blocked.ID})
+	test_db.Create(&users.BlockModel{BlockerID: blocker.ID, BlockedID: viewer.ID})
+	test_db.Create(&users.MuteModel{MuterID: viewer.ID, MutedID: muted.ID})
+	own := articleModelMocker(viewer, "Viewer writes")
+	for _, author := range []users.UserModel{blocked, blocker, muted} {
+		articleModel := articleModelMocker(author, "Written by "+author.Username)
+		commentModelMocker(own, author, "comment by "+author.Username)
+
+		slugs := func(viewer users.UserModel) []string {
+			models, _, _ := FindManyArticle("", author.Username, "20", "0", "", viewer)
+			var slugs []string
+			for _, model := range models {
+				slugs = append(slugs, model.Slug)
+			}
+			return slugs
+		}
+		asserts.Empty(slugs(viewer), "articles of "+author.Username+" should be hidden from the viewer")
+		asserts.Equal([]string{articleModel.Slug}, slugs(users.UserModel{}), "articles of "+author.Username+" should be listed for the others")
+		articleModel, _ = FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+		asserts.True(articleModel.visibleTo(viewer), "a direct link to an article of "+author.Username+" should still work")
+	}
+	commentModelMocker(own, viewer, "comment by the viewer")
+
+	own.getComments(viewer)
+	asserts.Equal(1, len(own.Comments), "comments of blocked, blocking and muted users should be hidden")
+	own.getComments(users.UserModel{})
+	asserts.Equal(4, len(own.Comments), "every comment should be listed for the others")
+	own.getComments(muted)
+	asserts.Equal(4, len(own.Comments), "muting should not affect the muted user")
+}
+
+func TestPrivateAuthors(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(3)
+	author, follower, stranger := mocks[0], mocks[1], mocks[2]
+	test_db.Model(&author).Update("private", true)
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: follower.ID})
+	articleModel := articleModelMocker(author, "Private thoughts")
+	articleModel, _ = FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+
+	for _, viewer := range []users.UserModel{author, follower, stranger, {}} {
+		models, count, _ := FindManyArticle("", author.Username, "20", "0", "", viewer)
+		visible := viewer.ID == author.ID || viewer.ID == follower.ID
+		if visible {
+			asserts.Equal(1, count, "articles of a private author should be listed for themselves and their followers")
+			asserts.Equal(articleModel.Slug, models[0].Slug, "articles of a private author should be listed for themselves and their followers")
+		} else {
+			asserts.Equal(0, count, "articles of a private author should be hidden from the others")
+		}
+		asserts.Equal(visible, articleModel.visibleTo(viewer), "a direct link should follow the same rules")
+	}
+}
+
+func TestModeratorEdit(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(2)
+	author, moderator := mocks[0], mocks[1]
+	test_db.Model(&moderator).Update("role", users.RoleModerator)
+	articleModel := articleModelMocker(author, "Edited by a moderator")
+	articleModel, _ = FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	asserts.True(articleModel.canBeEditedBy(moderator), "a moderator should be allowed to edit")
+
+	// The validator sets the author to the current user, as for a new article.
+	editor := GetArticleUserModel(moderator)
+	changes := ArticleModel{Title: "Moderated", Description: "moderated", Body: "moderated", Status: ArticlePublished, Author: editor}
+	asserts.NoError(articleModel.edit(changes, editor))
+	articleModel, _ = FindOneArticle(&ArticleModel{Slug: "moderated"})
+	asserts.Equal("Moderated", articleModel.Title, "the changes should be saved")
+	asserts.Equal(author.ID, articleModel.Author.UserModelID, "the author should stay the same after a moderator edit")
+	revision, _ := articleModel.findRevision(0)
+	asserts.Equal(editor.ID, revision.EditorID, "the revision should be the moderator's")
+}
+
+func TestDrafts(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(2)
+	author, follower := mocks[0], mocks[1]
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: follower.ID})
+	published := articleModelMocker(author, "Published article")
+	draft := articleModelMocker(author, "Draft article")
+	test_db.Model(&draft).Update("status", ArticleDraft)
+	draft, _ = FindOneArticle(&ArticleModel{Slug: draft.Slug})
+
+	for _, viewer := range []users.UserModel{author, follower, {}} {
+		models, count, _ := FindManyArticle("", author.Username, "20", "0", "", viewer)
+		var slugs []string
+		for _, model := range models {
+			slugs = append(slugs, model.Slug)
+		}
+		own := viewer.ID == author.ID
+		asserts.Contains(slugs, published.Slug, "a published article should be listed for everyone")
+		if own {
+			asserts.Equal(2, count, "a draft should be listed for its author")
+		} else {
+			asserts.Equal(1, count, "a draft should be hidden from the others")
+		}
+		asserts.Equal(own, draft.visibleTo(viewer), "a direct link to a draft should only work for its author")
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	asserts := assert.New(t)
+
+	mocks := userModelMocker(2)
+	author, editor := mocks[0], mocks[1]
+	// An article older than the revisions has none.
+	articleModel := ArticleModel{Title: "Revised v1", Slug: "revised-v1", Description: "d1", Body: "b1",
+		Author: GetArticleUserModel(author), Status: ArticlePublished}
+	test_db.Create(&articleModel)
+	articleModel, _ = FindOneArticle(&ArticleModel{Slug: "revised-v1"})
+
+	changes := func(title string) ArticleModel {
+		return ArticleModel{Title: title, Description: "d", Body: "b", Status: ArticlePublished}
+	}
+	asserts.NoError(articleModel.edit(changes("Revised v2"), GetArticleUserModel(editor)))
+	asserts.NoError(articleModel.edit(changes("Revised v2"), GetArticleUserModel(editor)))
+	asserts.NoError(articleModel.edit(changes("Revised v3"), GetArticleUserModel(editor)))
+	revisions, _ := articleModel.getRevisions()
+	asserts.Equal(3, len(revisions), "an edit without changes should not make a revision")
+	asserts.Equal([]uint{3, 2, 1}, []uint{revisions[0].Number, revisions[1].Number, revisions[2].Number}, "the revisions should be numbered from 1, the latest first")
+	asserts.Equal("Revised v1", revisions[2].Title, "the state before the first edit should be backfilled as revision 1")
+	asserts.Equal(author.ID, revisions[2].Editor.UserModelID, "the backfilled revision should be the author's")
+	asserts.Equal(editor.ID, revisions[0].Editor.UserModelID, "a revision should be the editor's")
+
+	diff, err := articleModel.diffRevisions(1, 3)
+	asserts.NoError(err)
+	asserts.Equal("--- revision 1\n+++ revision 3\n@@ -1,5 +1,5 @@\n-# Revised v1\n+# Revised v3\n \n-d1\n+d\n \n-b1\n+b\n", diff, "the diff should go from a revision to the other")
+
+	revision, _ := articleModel.findRevision(1)
+	asserts.NoError(articleModel.restoreRevision(revision, GetArticleUserModel(editor)))
+	restored, _ := FindOneArticle(&ArticleModel{Slug: "revised-v1"})
+	asserts.Equal("Revised v1", restored.Title, "the revision should be put back")
+	asserts.Equal("b1", restored.Body, "the revision should be put back")
+	latest, _ := restored.findRevision(0)
+	asserts.Equal(uint(4), latest.Number, "a restore should be saved as a new revision")
+	asserts.Equal(uint(1), latest.RestoredFrom, "a restore should record the revision it comes from")
+	moved, err := FindArticleBySlugHistory("revised-v3")
+	asserts.NoError(err)
+	asserts.Equal(restored.ID, moved.ID, "the slug before the restore should stay in the history")
+
+	// A change failing midway leaves nothing behind.
+	failed := errors.New("failed")
+	err = restored.saveChange(func(tx *gorm.DB) error {
+		if err := restored.setSlugFromTitle(tx, "Revised v5"); err != nil {
+			return err
+		}
+		return failed
+	})
+	asserts.Equal(failed, err)
+	asserts.Equal("revised-v1", restored.Slug, "the article should be back to its state before the change")
+	_, err = FindOneArticle(&ArticleModel{Slug: "revised-v5"})
+	asserts.Error(err, "the slug change should be rolled back")
+	_, err = FindArticleBySlugHistory("revised-v1")
+	asserts.Error(err, "the slug history should be rolled back")
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	asserts := assert.New(t)
+
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	asserts.Equal("", unifiedDiff("from", "to", from, from), "the same texts should have no diff")
+	asserts.Equal("--- from\n+++ to\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -8,5 +8,5 @@\n h\n i\n j\n-k\n+K\n l\n",
+		unifiedDiff("from", "to", from, strings.Replace(strings.Replace(from, "b", "B", 1), "k", "K", 1)),
+		"changes more than two contexts apart should be in separate hunks")
+	asserts.Equal("--- from\n+++ to\n@@ -1,8 +1,8 @@\n a\n-b\n+B\n c\n d\n-e\n+E\n f\n g\n h\n",
+		unifiedDiff("from", "to", from, strings.Replace(strings.Replace(from, "b", "B", 1), "e", "E", 1)),
+		"close changes should share a hunk")
+	asserts.Equal("--- from\n+++ to\n@@ -10,3 +10,4 @@\n j\n k\n l\n+m\n", unifiedDiff("from", "to", from, from+"m\n"),
+		"an addition should be counted in the range of the new text only")
+
+	// The diff should give back both texts with the fewest changes, the length of their longest common
+	// subsequence is checked against the quadratic table.
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + random.Intn(4)))
+		}
+		return lines
+	}
+	for n := 0; n < 500; n++ {
+		a, b := randomLines(), randomLines()
+		lcs := make([][]int, len(a)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(b)+1)
+		}
+		for i := len(a) - 1; i >= 0; i-- {
+			for j := len(b) - 1; j >= 0; j-- {
+				if a[i] == b[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] > lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		var from, to []string
+		common := 0
+		for _, line := range diffLines(a, b) {
+			if line.op != '+' {
+				from = append(from, line.text)
+			}
+			if line.op != '-' {
+				to = append(to, line.text)
+			}
+			if line.op == ' ' {
+				common++
+			}
+		}
+		asserts.Equal(strings.Join(a, ""), strings.Join(from, ""), "the diff should give back the old text")
+		asserts.Equal(strings.Join(b, ""), strings.Join(to, ""), "the diff should give back the new text")
+		asserts.Equal(lcs[0][0], common, "the diff of %v and %v should keep their longest common subsequence", a, b)
+	}
+
+	long := strings.Repeat("line\n", 50000)
+	asserts.Equal("--- from\n+++ to\n@@ -1,4 +1,4 @@\n-line\n+first\n line\n line\n line\n",
+		unifiedDiff("from", "to", long, "first\n"+strings.TrimPrefix(long, "line\n")), "long texts should be diffed")
+}
+
+func TestRendering(t *testing.T) {
+	asserts := assert.New(t)
+
+	// The Markdown and raw HTML versions of each attack, goldmark leaves the raw HTML out but the policies are
+	// checked on it too in case it doesn't.
+	attacks := map[string][2]string{
+		"<script>":         {"<script>alert(1)</script>", "<script>alert(1)</script>"},
+		"javascript: link": {"[click](javascript:alert(1))", `<a href="javascript:alert(1)">click</a>`},
+		"event attribute":  {`<img src="x.png" onerror="alert(1)">`, `<img src="x.png" onerror="alert(1)"><a href="https://example.com" onclick="alert(1)">x</a>`},
+	}
+	for name, policy := range map[string]*bluemonday.Policy{"article": articlePolicy, "comment": commentPolicy} {
+		for attack, sources := range attacks {
+			for _, rendered := range []string{renderMarkdown(sources[0], policy), policy.Sanitize(sources[1])} {
+				for _, unsafe := range []string{"<script", "alert(1)", "javascript:", "onerror", "onclick"} {
+					asserts.NotContains(rendered, unsafe, name+" policy should remove "+attack)
+				}
+			}
+		}
+	}
+	asserts.Contains(renderMarkdown("![cat](https://example.com/cat.png)", articlePolicy), "<img", "articles should allow images")
+	asserts.NotContains(renderMarkdown("![cat](https://example.com/cat.png)", commentPolicy), "<img", "comments should not allow images")
+	asserts.Contains(renderMarkdown("[site](https://example.com)", commentPolicy), `rel="nofollow"`, "the links of comments should be nofollow")
+	asserts.Contains(renderMarkdown("```go\nx := 1\n```", commentPolicy), `class="language-go"`, "code blocks should keep their language")
+
+	author := userModelMocker(1)[0]
+	saved := articleModelMocker(author, "Rendered once")
+	asserts.NoError(saved.edit(ArticleModel{Title: "Rendered once", Body: "**bold**", Status: ArticlePublished}, saved.Author))
+	legacy := ArticleModel{Title: "Rendered legacy", Slug: "rendered-legacy", Body: "*legacy*", Author: saved.Author, Status: ArticlePublished}
+	test_db.Create(&legacy)
+	revision, _ := saved.findRevision(0)
+	test_db.Model(&revision).UpdateColumn("body_html", "<p>saved</p>")
+
+	bodies := loadBodiesHTML([]ArticleModel{saved, legacy})
+	asserts.Equal("<p>saved</p>", bodies[saved.ID], "the HTML saved with the latest revision should be used")
+	asserts.Equal("<p><em>legacy</em></p>\n", bodies[legacy.ID], "an article without revisions should be rendered")
+
+	test_db.Model(&revision).UpdateColumn("body_html_version", markdownVersion-1)
+	bodies = loadBodiesHTML([]ArticleModel{saved})
+	asserts.Equal("<p><strong>bold</strong></p>\n", bodies[saved.ID], "the HTML of an older version should be rendered again")
+	revision, _ = saved.findRevision(0)
+	asserts.Equal(markdownVersion-1, revision.BodyHTMLVersion, "reading should not save anything")
+	asserts.NoError(RenderStaleRevisions(test_db))
+	revision, _ = saved.findRevision(0)
+	asserts.Equal(markdownVersion, revision.BodyHTMLVersion, "the stale revisions should be rendered at startup")
+	asserts.Equal("<p><strong>bold</strong></p>\n", revision.BodyHTML, "the stale revisions should be rendered at startup")
+}
+
+// The same searches for every engine, the word searched is only found in the articles of the engine.
+func testSearchEngine(t *testing.T, engine string) {
+	asserts := assert.New(t)
+
+	word := "quill" + engine
+	mocks := userModelMocker(3)
+	author, other, viewer := mocks[0], mocks[1], mocks[2]
+	article := func(userModel users.UserModel, title, body string, tags ...string) ArticleModel {
+		articleModel := ArticleModel{Title: title, Body: body, Author: GetArticleUserModel(userModel), Status: ArticlePublished}
+		articleModel.setTags(tags)
+		asserts.NoError(articleModel.create())
+		return articleModel
+	}
+	inBody := article(author, "Body mention "+engine, "some "+word+" text")
+	inTitle := article(author, "Title "+word, "nothing")
+	escaped := article(author, "Escaped "+engine, "<b>"+word+"</b> & co")
+	tagged := article(author, "Tagged "+engine, "a "+word, "tag"+word)
+	draft := article(author, "Draft "+engine, "a "+word)
+	test_db.Model(&draft).Update("status", ArticleDraft)
+	byOther := article(other, "Other "+engine, "a "+word)
+	inBody.favoriteBy(GetArticleUserModel(other))
+
+	search := func(tag, author, favorited string, viewer users.UserModel) ([]uint, []SearchResult) {
+		models, results, count, err := SearchArticles(word, tag, author, favorited, "20", "0", viewer)
+		asserts.NoError(err)
+		asserts.Equal(len(models), count, "every result should fit in the page")
+		asserts.Len(results, len(models), "every article should have its result")
+		var ids []uint
+		for i, model := range models {
+			ids = append(ids, model.ID)
+			asserts.Equal(model.ID, results[i].ArticleID, "the articles should be in the order of the results")
+			asserts.NotEmpty(model.Author.UserModel.Username, "the authors should be loaded with the articles")
+			if model.ID == tagged.ID {
+				asserts.Len(model.Tags, 1, "the tags should be loaded with the articles")
+			}
+		}
+		return ids, results
+	}
+	ids, results := search("", "", "", viewer)
+	asserts.ElementsMatch([]uint{inBody.ID, inTitle.ID, escaped.ID, tagged.ID, byOther.ID}, ids, "the drafts of the others should be hidden")
+	asserts.Equal(inTitle.ID, ids[0], "a match in the title should rank first")
+	for i, id := range ids {
+		if id == escaped.ID {
+			asserts.Contains(results[i].Snippet, "&lt;b&gt;<mark>"+word+"</mark>&lt;/b&gt; &amp; co", "the snippet should be escaped around the marks")
+		}
+	}
+	ids, _ = search("", "", "", author)
+	asserts.Contains(ids, draft.ID, "the drafts should be found by their author")
+
+	ids, _ = search("tag"+word, "", "", viewer)
+	asserts.Equal([]uint{tagged.ID}, ids, "the search should be filtered by tag")
+	ids, _ = search("", other.Username, "", viewer)
+	asserts.Equal([]uint{byOther.ID}, ids, "the search should be filtered by author")
+	ids, _ = search("", "", other.Username, viewer)
+	asserts.Equal([]uint{inBody.ID}, ids, "the search should be filtered by favorited")
+}
+
+func TestLikeSearch(t *testing.T) {
+	DefaultSearchEngine = LikeSearchEngine{}
+	testSearchEngine(t, "like")
+}
+
+func TestFTS5Search(t *testing.T) {
+	defer func() { DefaultSearchEngine = LikeSearchEngine{} }()
+	if err := SetupSearch(test_db); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := DefaultSearchEngine.(FTS5SearchEngine); !ok {
+		t.Skip("FTS5 needs the sqlite_fts5 build tag: go test -tags sqlite_fts5 ./...")
+	}
+	testSearchEngine(t, "fts")
+}
+
+func TestSlugs(t *testing.T) {
+	asserts := assert.New(t)
+
+	author := userModelMocker(1)[0]
+	first := articleModelMocker(author, "Slug collision")
+	second := articleModelMocker(author, "Slug collision!")
+	asserts.Equal("slug-collision", first.Slug, "the slug should be made from the title")
+	asserts.Equal("slug-collision-2", second.Slug, "a taken slug should get a suffix")
+	for _, title := range []string{"Feed", "Search"} {
+		reserved := articleModelMocker(author, title)
+		asserts.Equal(strings.ToLower(title)+"-2", reserved.Slug, "the slug of another route should get a suffix")
+	}
+
+	asserts.NoError(second.setSlugFromTitle(test_db, "Slug collision?"))
+	asserts.Equal("slug-collision-2", second.Slug, "a title giving the same slug should keep the suffix of the duplicate")
+	numbered := articleModelMocker(author, "Slug top 10")
+	asserts.NoError(numbered.setSlugFromTitle(test_db, "Slug top"))
+	asserts.Equal("slug-top", numbered.Slug, "a number of the title should not be taken for a suffix")
+
+	asserts.NoError(first.setSlugFromTitle(test_db, "Slug renamed"))
+	asserts.Equal("slug-renamed", first.Slug, "the slug should follow the title")
+	third := articleModelMocker(author, "Slug collision")
+	asserts.Equal("slug-collision-3", third.Slug, "an old slug should stay with its article")
+	for _, title := range []string{"Slug gap", "Slug gap ten", "Slug gap 7"} {
+		articleModelMocker(author, title)
+	}
+	gap := articleModelMocker(author, "Slug gap")
+	asserts.Equal("slug-gap-8", gap.Slug, "a duplicate should get the suffix after the last one")
+	test_db.Delete(&gap)
+	gap = articleModelMocker(author, "Slug gap")
+	asserts.Equal("slug-gap-9", gap.Slug, "the slug of a deleted article should stay taken")
+
+	request := articlesRouter()
+	w := request("GET", "/api/articles/slug-collision?x=1", 0)
+	asserts.Equal(http.StatusFound, w.Code, "an old slug should redirect")
+	asserts.Equal("/api/articles/slug-renamed?x=1", w.Header().Get("Location"), "an old slug should redirect to the current one")
+	w = request("GET", "/api/articles/slug-renamed", 0)
+	asserts.Equal(http.StatusOK, w.Code, "the current slug should be found")
+	w = request("GET", "/api/articles/slug-unknown", 0)
+	asserts.Equal(http.StatusNotFound, w.Code, "an unknown slug should not be found")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	test_db.AutoMigrate(&ArticleModel{}, &TagModel{}, &FavoriteModel{}, &ArticleUserModel{}, &CommentModel{},
+		&ArticleSlugModel{}, &ArticleRevisionModel{})
+	users.RegisterAccountDeletionHook(DeleteUserContent)
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
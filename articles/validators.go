@@ -1,10 +1,10 @@
 package articles
 
 import (
-	"github.com/gosimple/slug"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
 	"github.com/gin-gonic/gin"
+	"time"
 )
 
 type ArticleModelValidator struct {
@@ -13,6 +13,9 @@ type ArticleModelValidator struct {
 		Description string   `form:"description" json:"description" binding:"max=2048"`
 		Body        string   `form:"body" json:"body" binding:"max=2048"`
 		Tags        []string `form:"tagList" json:"tagList"`
+		// Published when left out, PublishAt is the time a scheduled article gets published.
+		Status    string     `form:"status" json:"status"`
+		PublishAt *time.Time `form:"publishAt" json:"publishAt"`
 	} `json:"article"`
 	articleModel ArticleModel `json:"-"`
 }
@@ -29,6 +32,9 @@ func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelVal
 	for _, tagModel := range articleModel.Tags {
 		articleModelValidator.Article.Tags = append(articleModelValidator.Article.Tags, tagModel.Tag)
 	}
+	articleModelValidator.Article.Status = articleModel.Status
+	articleModelValidator.Article.PublishAt = articleModel.PublishAt
+	articleModelValidator.articleModel.PublishedAt = articleModel.PublishedAt
 	return articleModelValidator
 }
 
@@ -39,7 +45,12 @@ func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	s.articleModel.Slug = slug.Make(s.Article.Title)
+	if s.Article.Status == "" {
+		s.Article.Status = ArticlePublished
+	}
+	if err := s.articleModel.setStatus(s.Article.Status, s.Article.PublishAt, time.Now()); err != nil {
+		return err
+	}
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
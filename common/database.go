@@ -5,6 +5,7 @@ import (
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"os"
+	"strings"
 )
 
 type Database struct {
@@ -48,3 +49,15 @@ func TestDBFree(test_db *gorm.DB) error {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// Tell whether err comes from a unique index, the message differs between sqlite, MySQL and PostgreSQL.
+// 	if common.IsUniqueViolation(err) { c.JSON(http.StatusConflict, ...) }
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "UNIQUE constraint failed") ||
+		strings.Contains(message, "Duplicate entry") ||
+		strings.Contains(message, "duplicate key value")
+}
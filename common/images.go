@@ -0,0 +1,107 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// The content types accepted for uploaded images, they are sniffed from the first bytes whatever the client claims.
+var ImageContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// DecodeImage checks the size, the content type and the dimensions of an uploaded image before decoding it,
+// the broken limit is reported as a FieldError on field. Only the pixels are kept, so the EXIF block
+// and any other metadata of the file are dropped once the image is encoded again.
+// 	img, format, err := common.DecodeImage(file, "Avatar", 5<<20, 4096)
+func DecodeImage(r io.Reader, field string, maxSize int64, maxDimension int) (image.Image, string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, "", FieldError{Field: field, Message: fmt.Sprintf("{max: %v}", maxSize)}
+	}
+	if !ImageContentTypes[http.DetectContentType(data)] {
+		return nil, "", FieldError{Field: field, Message: "{key: type}"}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", FieldError{Field: field, Message: "{key: image}"}
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return nil, "", FieldError{Field: field, Message: fmt.Sprintf("{dimensions: %v}", maxDimension)}
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", FieldError{Field: field, Message: "{key: image}"}
+	}
+	return img, format, nil
+}
+
+// The centered square of img scaled down to size, smaller images are not enlarged.
+func CropSquare(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2))
+	if size > side {
+		size = side
+	}
+	return scale(img, crop, size, size)
+}
+
+// The whole img scaled down to width keeping its aspect ratio, narrower images are not enlarged.
+func FitWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return scale(img, bounds, width, height)
+}
+
+func scale(img image.Image, src image.Rectangle, width, height int) image.Image {
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, src, draw.Src, nil)
+	return scaled
+}
+
+// The extension and the content type of the files written by EncodeImage for a decoded format.
+func ImageType(format string) (string, string) {
+	if format == "jpeg" {
+		return ".jpg", "image/jpeg"
+	}
+	return ".png", "image/png"
+}
+
+// EncodeImage writes img back in the format DecodeImage found, JPEG stays JPEG and the other formats become PNG.
+// 	data, err := common.EncodeImage(img, format)
+func EncodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// A plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// A Mailer sends the emails of the application, like the verification links.
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// The mailer used by every module, LogMailer until an SMTP server is configured.
+var DefaultMailer Mailer = LogMailer{}
+
+// A Mailer writing the emails to the log instead of sending them, for development.
+type LogMailer struct{}
+
+func (LogMailer) Send(mail Mail) error {
+	log.Printf("mail to %s: %s\n%s", mail.To, mail.Subject, mail.Body)
+	return nil
+}
+
+// A Mailer sending the emails through an SMTP server, Auth may be nil when the server doesn't need it.
+// 	mailer := common.SMTPMailer{Addr: "localhost:25", From: "noreply@example.com"}
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m SMTPMailer) Send(mail Mail) error {
+	// The header values come from our own templates and user emails checked by the validators,
+	// line breaks are still refused so nobody can add headers.
+	if strings.ContainsAny(mail.To+mail.Subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+	message := "From: " + m.From + "\r\n" +
+		"To: " + mail.To + "\r\n" +
+		"Subject: " + mail.Subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.Replace(mail.Body, "\n", "\r\n", -1)
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{mail.To}, []byte(message))
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// The request IDs coming from a proxy are kept when they look sane, so the logs of both sides can be matched.
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Give every request an ID, sent back in the X-Request-ID header and stored in the audit log entries.
+// 	r.Use(common.RequestIDMiddleware())
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = RandToken(8)
+		}
+		c.Set("request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// The ID of the request, empty when RequestIDMiddleware is not used.
+func RequestID(c *gin.Context) string {
+	return c.GetString("request_id")
+}
@@ -0,0 +1,258 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Storage keeping the files in a bucket of Amazon S3 or of any server speaking its API, like MinIO.
+// Requests are signed with AWS Signature Version 4: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+//
+// Endpoint looks like "https://s3.amazonaws.com" or "http://localhost:9000". With PathStyle the bucket goes in the path
+// ("http://localhost:9000/bucket/key", what MinIO expects), otherwise in the host ("https://bucket.s3.amazonaws.com/key").
+// PublicURL is an optional CDN or website address the public files are reached through instead of the endpoint.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	PublicURL string
+	Client    *http.Client
+	now       func() time.Time
+}
+
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey string, pathStyle bool) *S3Storage {
+	return &S3Storage{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: pathStyle,
+		Client:    http.DefaultClient,
+		now:       time.Now,
+	}
+}
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// The address of key in the bucket, split in the host and the path escaped the way the signature expects it.
+type s3Object struct {
+	scheme string
+	host   string
+	path   string
+}
+
+func (o s3Object) String() string {
+	return o.scheme + "://" + o.host + o.path
+}
+
+func (s *S3Storage) object(key string) (s3Object, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return s3Object{}, ErrInvalidStorageKey
+	}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return s3Object{}, err
+	}
+	object := s3Object{scheme: endpoint.Scheme, host: endpoint.Host, path: "/" + s3Escape(key, false)}
+	if s.PathStyle {
+		object.path = "/" + s3Escape(s.Bucket, true) + object.path
+	} else {
+		object.host = s.Bucket + "." + object.host
+	}
+	return object, nil
+}
+
+// URI encoding of the signature: every byte but the unreserved characters is percent encoded,
+// the slashes of an object key are kept unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *S3Storage) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+}
+
+// The signature of a canonical request made at t, headers must be the lower case names sorted with their values.
+func (s *S3Storage) signature(t time.Time, method, escapedPath, query string, headers [][2]string, payloadHash string) (string, string) {
+	var canonicalHeaders strings.Builder
+	var signedHeaders []string
+	for _, header := range headers {
+		canonicalHeaders.WriteString(header[0] + ":" + strings.TrimSpace(header[1]) + "\n")
+		signedHeaders = append(signedHeaders, header[0])
+	}
+	canonicalRequest := strings.Join([]string{
+		method, escapedPath, query, canonicalHeaders.String(), strings.Join(signedHeaders, ";"), payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		s3Algorithm, t.Format(s3TimeFormat), s.scope(t), sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), strings.Join(signedHeaders, ";")
+}
+
+// Send a request signed in the Authorization header.
+func (s *S3Storage) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, object.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	t := s.now().UTC()
+	payloadHash := sha256Hex(body)
+	headers := [][2]string{{"host", object.host}, {"x-amz-content-sha256", payloadHash}, {"x-amz-date", t.Format(s3TimeFormat)}}
+	if contentType != "" {
+		headers = append([][2]string{{"content-type", contentType}}, headers...)
+		req.Header.Set("Content-Type", contentType)
+	}
+	signature, signedHeaders := s.signature(t, method, object.path, "", headers, payloadHash)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, s.scope(t), signedHeaders, signature))
+	req.ContentLength = int64(len(body))
+	return s.Client.Do(req)
+}
+
+func s3Error(op, key string, res *http.Response) error {
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	if res.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return fmt.Errorf("s3 %s %s: %s %s", op, key, res.Status, strings.TrimSpace(string(message)))
+}
+
+func (s *S3Storage) Put(key string, r io.Reader, contentType string) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(http.MethodPut, key, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error("put", key, res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error("get", key, res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error("delete", key, res)
+	}
+	return nil
+}
+
+func (s *S3Storage) URL(key string) string {
+	if s.PublicURL != "" {
+		return strings.TrimRight(s.PublicURL, "/") + "/" + s3Escape(key, false)
+	}
+	object, err := s.object(key)
+	if err != nil {
+		return ""
+	}
+	return object.String()
+}
+
+// A presigned GET URL, the signature goes in the query string so the link works without any header.
+// 	url, err := storage.SignedURL("exports/1-xxxx.zip", 15*time.Minute)
+func (s *S3Storage) SignedURL(key string, ttl time.Duration) (string, error) {
+	object, err := s.object(key)
+	if err != nil {
+		return "", err
+	}
+	t := s.now().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.AccessKey + "/" + s.scope(t)},
+		"X-Amz-Date":          {t.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(ttl / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	signature, _ := s.signature(t, http.MethodGet, object.path, canonicalQuery, [][2]string{{"host", object.host}}, s3UnsignedPayload)
+	return object.String() + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
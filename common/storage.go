@@ -0,0 +1,205 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A Storage keeps uploaded files under slash separated keys like "avatars/1/xxxx-medium.jpg".
+type Storage interface {
+	// Put writes the content of r under key, replacing the previous file if any.
+	Put(key string, r io.Reader, contentType string) error
+	// Get opens the file stored under key, the error satisfies os.IsNotExist when there is none.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the file stored under key, deleting a missing file is not an error.
+	Delete(key string) error
+	// URL returns the public address of the file stored under key.
+	URL(key string) string
+	// SignedURL returns an address of the file stored under key which stops working after ttl,
+	// it is the only way to reach the files below PrivateMediaPrefixes.
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+var ErrInvalidStorageKey = errors.New("invalid storage key")
+
+var ErrNoSigningSecret = errors.New("no secret to sign the media URLs")
+
+// The storage of the uploaded files, MediaRetrieve serves the local files from our own domain.
+// It has no signing secret until the server configures one, so the private files can't be reached before.
+var MediaStorage Storage = NewLocalStorage("./../media", "http://localhost:8080/media", nil)
+
+// The files below these prefixes are only served through a SignedURL, e.g. the personal data exports.
+var PrivateMediaPrefixes = []string{"exports/"}
+
+func isPrivateMediaKey(key string) bool {
+	for _, prefix := range PrivateMediaPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Storage writing the files in a directory of the local filesystem.
+// BaseURL is where MediaRegister is mounted, e.g. "https://example.com/media",
+// Secret signs the URLs of SignedURL so MediaRetrieve can check them, keep it private and apart from
+// the other secrets: whoever knows it can download every private file.
+type LocalStorage struct {
+	Root    string
+	BaseURL string
+	Secret  []byte
+}
+
+// You could create a local storage signing its URLs with a random secret of at least MinSigningSecretLength bytes.
+// 	storage := common.NewLocalStorage("./media", "https://example.com/media", []byte(os.Getenv("MEDIA_SIGNING_SECRET")))
+func NewLocalStorage(root, baseURL string, secret []byte) LocalStorage {
+	return LocalStorage{Root: root, BaseURL: strings.TrimRight(baseURL, "/"), Secret: secret}
+}
+
+const MinSigningSecretLength = 32
+
+// The path of key below Root, keys climbing out of Root with ".." are rejected.
+func (s LocalStorage) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return "", ErrInvalidStorageKey
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes a temporary file first so that a reader never sees a partial file.
+func (s LocalStorage) Put(key string, r io.Reader, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+func (s LocalStorage) Get(key string) (io.ReadCloser, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: key, Err: os.ErrNotExist}
+	}
+	return os.Open(name)
+}
+
+func (s LocalStorage) Delete(key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s LocalStorage) URL(key string) string {
+	return s.BaseURL + "/" + key
+}
+
+func (s LocalStorage) signature(key string, expires string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The URL carries its expiry time and an HMAC of the key and the expiry time.
+// 	url, err := storage.SignedURL("exports/1-xxxx.zip", 15*time.Minute)
+func (s LocalStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	if len(s.Secret) == 0 {
+		return "", ErrNoSigningSecret
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	query := url.Values{"expires": {expires}, "signature": {s.signature(key, expires)}}
+	return s.URL(key) + "?" + query.Encode(), nil
+}
+
+// ValidSignature tells whether the expires and signature parameters of a SignedURL of key are valid at now.
+func (s LocalStorage) ValidSignature(key, expires, signature string, now time.Time) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix || len(s.Secret) == 0 {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(s.signature(key, expires)))
+}
+
+// Serve the files of MediaStorage, mount it without authentication:
+// 	common.MediaRegister(r.Group("/media"))
+func MediaRegister(router *gin.RouterGroup) {
+	router.GET("/*key", MediaRetrieve)
+}
+
+// The keys of the stored files are never reused, so the public ones can be cached forever.
+// The private files need a valid signature, only the storages able to check it serve them.
+func MediaRetrieve(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	headers := map[string]string{
+		"Cache-Control":          "public, max-age=31536000, immutable",
+		"X-Content-Type-Options": "nosniff",
+	}
+	if isPrivateMediaKey(key) {
+		signer, ok := MediaStorage.(interface {
+			ValidSignature(key, expires, signature string, now time.Time) bool
+		})
+		if !ok || !signer.ValidSignature(key, c.Query("expires"), c.Query("signature"), time.Now()) {
+			c.JSON(http.StatusNotFound, NewError("media", errors.New("Invalid key")))
+			return
+		}
+		headers["Cache-Control"] = "private, no-store"
+		headers["Content-Disposition"] = fmt.Sprintf("attachment; filename=%q", path.Base(key))
+	}
+	file, err := MediaStorage.Get(key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, NewError("media", errors.New("Invalid key")))
+		return
+	}
+	defer file.Close()
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, -1, contentType, file, headers)
+}
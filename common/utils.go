@@ -2,6 +2,8 @@
 package common
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"time"
@@ -24,6 +26,16 @@ func RandString(n int) string {
 	return string(b)
 }
 
+// A helper function to generate an unguessable token of n random bytes, hex encoded,
+// use it instead of RandString for the codes and links which grant something.
+func RandToken(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // Keep this two config private, it should not expose to open source
 const NBSecretPassword = "A String Very Very Very Strong!!@##$!@#$"
 const NBRandomPassword = "A String Very Very Very Niubilty!!@##$!@#4"
@@ -31,16 +43,33 @@ const NBRandomPassword = "A String Very Very Very Niubilty!!@##$!@#4"
 // A Util function to generate jwt_token which can be used in the request header
 func GenToken(id uint) string {
 	jwt_token := jwt.New(jwt.GetSigningMethod("HS256"))
-	// Set some claims
+	// Set some claims, iat tells whether the token was issued before the tokens of the user got revoked
+	now := time.Now()
 	jwt_token.Claims = jwt.MapClaims{
 		"id":  id,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour * 24).Unix(),
 	}
 	// Sign and get the complete encoded token as a string
 	token, _ := jwt_token.SignedString([]byte(NBSecretPassword))
 	return token
 }
 
+// A token of the user id acting as an administrator actorID, only valid during ttl.
+// The "act" claim tells the requests made with it apart, see users.Impersonator.
+func GenImpersonationToken(id uint, actorID uint, ttl time.Duration) string {
+	jwt_token := jwt.New(jwt.GetSigningMethod("HS256"))
+	now := time.Now()
+	jwt_token.Claims = jwt.MapClaims{
+		"id":  id,
+		"act": actorID,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	token, _ := jwt_token.SignedString([]byte(NBSecretPassword))
+	return token
+}
+
 // My own Error type that will help return my customized Error info
 //  {"database": {"hello":"no such table", error: "not_exists"}}
 type CommonError struct {
@@ -52,6 +81,10 @@ type CommonError struct {
 func NewValidatorError(err error) CommonError {
 	res := CommonError{}
 	res.Errors = make(map[string]interface{})
+	if fieldErr, ok := err.(FieldError); ok {
+		res.Errors[fieldErr.Field] = fieldErr.Message
+		return res
+	}
 	errs := err.(validator.ValidationErrors)
 	for _, v := range errs {
 		// can translate each error one at a time.
@@ -66,6 +99,18 @@ func NewValidatorError(err error) CommonError {
 	return res
 }
 
+// A validation error found by our own checking logic instead of the binding tags,
+// NewValidatorError reports it under the field name like the other validation errors.
+// 	return common.FieldError{"Password", "{key: breached}"}
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
 // Warp the error info in a object
 func NewError(key string, err error) CommonError {
 	res := CommonError{}
@@ -2,6 +2,13 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
@@ -18,6 +25,14 @@ func Migrate(db *gorm.DB) {
 	db.AutoMigrate(&articles.FavoriteModel{})
 	db.AutoMigrate(&articles.ArticleUserModel{})
 	db.AutoMigrate(&articles.CommentModel{})
+	db.AutoMigrate(&articles.ArticleSlugModel{})
+	db.AutoMigrate(&articles.ArticleRevisionModel{})
+	if err := articles.SetupSearch(db); err != nil {
+		fmt.Println("search err: ", err)
+	}
+	if err := articles.RenderStaleRevisions(db); err != nil {
+		fmt.Println("rendering err: ", err)
+	}
 }
 
 func main() {
@@ -26,7 +41,105 @@ func main() {
 	Migrate(db)
 	defer db.Close()
 
+	users.RegisterAccountDeletionHook(articles.DeleteUserContent)
+	users.RegisterExportSection(articles.ExportUserContent)
+	users.RegisterSuggestionSource(articles.SuggestFavoritedAuthors)
+	users.RegisterSuggestionSource(articles.SuggestTagAuthors)
+	go users.StartExportJanitor(time.Hour)
+	go articles.StartPublishScheduler(time.Minute)
+	if os.Getenv("DELETED_USER_CONTENT") == articles.DeletedUserContentDelete {
+		articles.DeletedUserContent = articles.DeletedUserContentDelete
+	}
+
+	// Share the login failure counters through the database when running several instances.
+	if os.Getenv("LOGIN_THROTTLE_STORE") == "db" {
+		users.LoginThrottler.Store = users.NewDBLoginAttemptStore()
+	}
+	// Existing hashes made with other parameters are upgraded on the next login.
+	if os.Getenv("PASSWORD_HASHER") == "argon2id" {
+		users.CurrentPasswordHasher = users.NewArgon2idHasher()
+	} else if value := os.Getenv("BCRYPT_COST"); value != "" {
+		cost, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalln("bcrypt cost err: ", err)
+		}
+		hasher, err := users.NewBcryptHasher(cost)
+		if err != nil {
+			log.Fatalln("bcrypt cost err: ", err)
+		}
+		users.CurrentPasswordHasher = hasher
+	}
+	// See users.LoadPasswordPolicy for the PASSWORD_* settings, a policy which can't be read stops the server
+	// rather than accepting weaker passwords than intended.
+	policy, err := users.LoadPasswordPolicy(users.DefaultPasswordPolicy, os.Getenv)
+	if err != nil {
+		log.Fatalln("password policy err: ", err)
+	}
+	users.DefaultPasswordPolicy = policy
+
+	// Emails are written to the log unless SMTP_ADDR is set, EMAIL_CONFIRM_URL is the front end page confirming an email change.
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		mailer := common.SMTPMailer{Addr: addr, From: os.Getenv("SMTP_FROM")}
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			mailer.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		common.DefaultMailer = mailer
+	}
+	if url := os.Getenv("EMAIL_CONFIRM_URL"); url != "" {
+		users.EmailConfirmURL = url
+	}
+
+	// ADMIN_USERNAME is given the admin role, the first admin can only be appointed this way.
+	if username := strings.TrimSpace(os.Getenv("ADMIN_USERNAME")); username != "" {
+		if err := users.EnsureRole(username, users.RoleAdmin); err != nil {
+			fmt.Println("admin err: ", username, err)
+		}
+	}
+	// MODERATORS is a comma-separated list of usernames given the moderator role, the admins can change it later.
+	for _, username := range strings.Split(os.Getenv("MODERATORS"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			if err := users.EnsureRole(username, users.RoleModerator); err != nil {
+				fmt.Println("moderator err: ", username, err)
+			}
+		}
+	}
+
+	// REGISTRATION_MODE is open, invite (an invitation code is needed to sign up) or closed.
+	switch mode := os.Getenv("REGISTRATION_MODE"); mode {
+	case users.RegistrationOpen, users.RegistrationInvite, users.RegistrationClosed:
+		users.RegistrationMode = mode
+	case "":
+	default:
+		fmt.Println("registration mode err: unknown mode", mode)
+	}
+
+	// Uploaded files go to an S3-compatible bucket with STORAGE=s3, use S3_PATH_STYLE=true for MinIO.
+	// Otherwise they are written below MEDIA_DIR and served under /media, MEDIA_BASE_URL is its public address
+	// and MEDIA_SIGNING_SECRET, a random string of at least 32 characters, signs the links of the private files.
+	if os.Getenv("STORAGE") == "s3" {
+		s3 := common.NewS3Storage(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_REGION"), os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), os.Getenv("S3_PATH_STYLE") == "true")
+		s3.PublicURL = os.Getenv("S3_PUBLIC_URL")
+		common.MediaStorage = s3
+	} else {
+		secret := os.Getenv("MEDIA_SIGNING_SECRET")
+		if len(secret) < common.MinSigningSecretLength {
+			log.Fatalln("media storage err: ", fmt.Errorf("MEDIA_SIGNING_SECRET should be at least %v characters", common.MinSigningSecretLength))
+		}
+		local := common.MediaStorage.(common.LocalStorage)
+		if dir := os.Getenv("MEDIA_DIR"); dir != "" {
+			local.Root = dir
+		}
+		if baseURL := os.Getenv("MEDIA_BASE_URL"); baseURL != "" {
+			local.BaseURL = baseURL
+		}
+		common.MediaStorage = common.NewLocalStorage(local.Root, local.BaseURL, []byte(secret))
+	}
+
 	r := gin.Default()
+	r.Use(common.RequestIDMiddleware())
+	common.MediaRegister(r.Group("/media"))
 
 	v1 := r.Group("/api")
 	users.UsersRegister(v1.Group("/users"))
@@ -37,6 +150,9 @@ func main() {
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
+	admin := v1.Group("/admin")
+	admin.Use(users.RequireRole(users.RoleAdmin))
+	users.AdminRegister(admin)
 
 	articles.ArticlesRegister(v1.Group("/articles"))
 
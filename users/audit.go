@@ -0,0 +1,157 @@
+package users
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// An entry of the security audit log. UserModelID is the account concerned, ActorID who did it: they differ when
+// a moderator deletes the content of somebody else, and ActorID is 0 for the anonymous requests like a failed login.
+// The log is append-only, the entries are neither updated nor deleted, even with the account.
+type SecurityEventModel struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	UserModelID uint   `gorm:"index"`
+	ActorID     uint   `gorm:"index"`
+	Type        string `gorm:"index"`
+	IP          string
+	UserAgent   string
+	RequestID   string
+	Details     string `gorm:"type:text"`
+}
+
+const (
+	EventLoginSucceeded       = "login_succeeded"
+	EventLoginFailed          = "login_failed"
+	EventPasswordChanged      = "password_changed"
+	EventEmailChangeRequested = "email_change_requested"
+	EventEmailChanged         = "email_changed"
+	EventTokensRevoked        = "tokens_revoked"
+	EventRoleChanged          = "role_changed"
+	EventArticleDeleted       = "article_deleted"
+	EventCommentDeleted       = "comment_deleted"
+	EventAccountDeleted       = "account_deleted"
+	EventImpersonationStarted = "impersonation_started"
+	EventImpersonatedRequest  = "impersonated_request"
+)
+
+var ErrSecurityEventAppendOnly = errors.New("security events are append-only")
+
+// The email typed at a failed login is masked before it goes to the log: it may be the address of anybody,
+// or even a password typed in the wrong field. "someone@example.com" gives "s***@example.com".
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "***"
+	}
+	local := []rune(email[:at])
+	if len(local) == 0 {
+		return "***" + email[at:]
+	}
+	return string(local[0]) + "***" + email[at:]
+}
+
+func (event *SecurityEventModel) BeforeUpdate() error {
+	return ErrSecurityEventAppendOnly
+}
+
+func (event *SecurityEventModel) BeforeDelete() error {
+	return ErrSecurityEventAppendOnly
+}
+
+// You could record what happened to the account of subject during the request, the actor is the authenticated user,
+// or the admin impersonating it.
+// A failure is only logged: the audit log never makes the action itself fail.
+// 	users.RecordSecurityEvent(c, users.EventArticleDeleted, author, map[string]interface{}{"slug": slug})
+func RecordSecurityEvent(c *gin.Context, eventType string, subject UserModel, details map[string]interface{}) {
+	var actorID uint
+	if myUserModel, ok := c.Get("my_user_model"); ok {
+		actorID = myUserModel.(UserModel).ID
+	}
+	if impersonator, ok := Impersonator(c); ok {
+		actorID = impersonator.ID
+	}
+	recordSecurityEvent(SecurityEventModel{
+		UserModelID: subject.ID,
+		ActorID:     actorID,
+		Type:        eventType,
+		IP:          c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		RequestID:   common.RequestID(c),
+	}, details)
+}
+
+func recordSecurityEvent(event SecurityEventModel, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(details)
+	if err == nil {
+		event.Details = string(encoded)
+		err = common.GetDB().Create(&event).Error
+	}
+	if err != nil {
+		log.Printf("audit: recording %s of user %d failed: %v", event.Type, event.UserModelID, err)
+	}
+}
+
+// The filters of the audit log queries, the zero values match everything.
+type SecurityEventFilter struct {
+	UserModelID uint
+	ActorID     uint
+	Type        string
+}
+
+// You could get a page of the audit log, the most recent entries first, with the total count.
+// 	events, count, err := FindSecurityEvents(SecurityEventFilter{UserModelID: myUserModel.ID}, 20, 0)
+func FindSecurityEvents(filter SecurityEventFilter, limit, offset int) ([]SecurityEventModel, int, error) {
+	db := common.GetDB()
+	var events []SecurityEventModel
+	var count int
+	query := db.Model(&SecurityEventModel{})
+	if filter.UserModelID != 0 {
+		query = query.Where("user_model_id = ?", filter.UserModelID)
+	}
+	if filter.ActorID != 0 {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return events, count, err
+	}
+	err := query.Order("id DESC").Offset(offset).Limit(limit).Find(&events).Error
+	return events, count, err
+}
+
+// The audit log of the user, in the personal data exports.
+func exportSecurityEvents(u UserModel) (map[string][]byte, error) {
+	var events []SecurityEventModel
+	if err := common.GetDB().Where("user_model_id = ?", u.ID).Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	response := []map[string]interface{}{}
+	for _, event := range events {
+		var details interface{}
+		json.Unmarshal([]byte(event.Details), &details)
+		response = append(response, map[string]interface{}{
+			"type":      event.Type,
+			"ip":        event.IP,
+			"userAgent": event.UserAgent,
+			"details":   details,
+			"createdAt": event.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"security_events.json": data}, nil
+}
@@ -0,0 +1,102 @@
+package users
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// The limits of an uploaded avatar, larger files or images are rejected before being resized.
+var (
+	AvatarMaxSize      int64 = 5 << 20
+	AvatarMaxDimension       = 4096
+)
+
+// An avatar is cropped to a square and stored in every variant size,
+// ProfileResponse.Image points at the AvatarProfileVariant one.
+type AvatarVariant struct {
+	Name string
+	Size int
+}
+
+var AvatarVariants = []AvatarVariant{{"small", 64}, {"medium", 256}, {"large", 512}}
+
+const AvatarProfileVariant = "medium"
+
+// The storage key of a variant, "avatars/1/xxxx.jpg" gives "avatars/1/xxxx-small.jpg".
+func avatarVariantKey(key, variant string) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "-" + variant + ext
+}
+
+// You could replace the avatar of a user by an uploaded image, the variants are written to common.MediaStorage
+// and the files of the previous avatar are removed.
+// 	err := myUserModel.setAvatar(file)
+func (u *UserModel) setAvatar(r io.Reader) error {
+	img, format, err := common.DecodeImage(r, "Avatar", AvatarMaxSize, AvatarMaxDimension)
+	if err != nil {
+		return err
+	}
+	ext, contentType := common.ImageType(format)
+	key := fmt.Sprintf("avatars/%d/%s%s", u.ID, common.RandString(16), ext)
+
+	var imageURL string
+	for _, variant := range AvatarVariants {
+		data, err := common.EncodeImage(common.CropSquare(img, variant.Size), format)
+		if err == nil {
+			err = common.MediaStorage.Put(avatarVariantKey(key, variant.Name), bytes.NewReader(data), contentType)
+		}
+		if err != nil {
+			removeAvatarFiles(key)
+			return err
+		}
+		if variant.Name == AvatarProfileVariant {
+			imageURL = common.MediaStorage.URL(avatarVariantKey(key, variant.Name))
+		}
+	}
+
+	previous := u.AvatarKey
+	if err := u.Update(map[string]interface{}{"image": imageURL, "avatar_key": key}); err != nil {
+		removeAvatarFiles(key)
+		return err
+	}
+	return removeAvatarFiles(previous)
+}
+
+// You could forget the uploaded avatar of a user, e.g. when the image is set to another URL.
+// 	err := myUserModel.removeAvatar()
+func (u *UserModel) removeAvatar() error {
+	if u.AvatarKey == "" {
+		return nil
+	}
+	previous := u.AvatarKey
+	if err := u.Update(map[string]interface{}{"avatar_key": ""}); err != nil {
+		return err
+	}
+	return removeAvatarFiles(previous)
+}
+
+func removeAvatarFiles(key string) error {
+	for _, variantKey := range avatarFileKeys(key) {
+		if err := common.MediaStorage.Delete(variantKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The keys of every variant of an avatar, none when there is no avatar.
+func avatarFileKeys(key string) []string {
+	if key == "" {
+		return nil
+	}
+	var keys []string
+	for _, variant := range AvatarVariants {
+		keys = append(keys, avatarVariantKey(key, variant.Name))
+	}
+	return keys
+}
@@ -8,5 +8,29 @@ routers.go: router binding and core logic
 serializers.go: definition the schema of return data
 
 validators.go: definition the validator of form data
+
+passwords.go: password policy and the breached password corpus
+
+hashers.go: bcrypt and argon2id password hashing
+
+exports.go: building the personal data export archives in background
+
+throttle.go: counting failed logins per email and per IP to lock out brute-force attempts
+
+avatars.go: validating, cleaning and resizing the uploaded avatars
+
+usernames.go: username changes, the history of old usernames and their redirects
+
+identities.go: the canonical usernames and emails, and the confusable usernames
+
+emails.go: email changes confirmed through a verification link sent to the new address
+
+invitations.go: the registration mode and the invitation codes needed to sign up on an invite-only instance
+
+audit.go: the append-only security audit log of the account events
+
+impersonation.go: the short-lived tokens letting the admins see the site as another user
+
+suggestions.go: who-to-follow suggestions from the follow graph and the registered sources
 */
 package users
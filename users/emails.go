@@ -0,0 +1,146 @@
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// A pending change of the email of a user, it is applied once the new address is confirmed with the token
+// sent to it. Only the hash of the token is stored, so a leaked database can't confirm anything.
+type EmailChangeModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint
+	NewEmail    string
+	TokenHash   string `gorm:"unique_index"`
+	ExpiresAt   time.Time
+}
+
+// How long the verification link sent to the new address works.
+var EmailChangeTTL = 24 * time.Hour
+
+// The address of the verification link, the token is appended to it. It should be a page of the front end
+// posting the token to /api/users/email/confirm, so that opening the link alone doesn't change anything.
+var EmailConfirmURL = "http://localhost:4100/settings/email?token="
+
+var ErrEmailTaken = errors.New("Email is already taken")
+
+const emailChangeTokenBytes = 32
+
+func emailChangeTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// You could check whether email belongs to another user than u once canonicalized, see canonicalEmail.
+func isEmailTaken(email string, u UserModel) bool {
+	db := common.GetDB()
+	var count int
+	db.Model(&UserModel{}).Where("email_canonical = ? AND id <> ?", canonicalEmail(email), u.ID).Count(&count)
+	return count > 0
+}
+
+// You could start changing the email of a user: a verification link goes to the new address and a notice
+// to the current one, the previous pending change is forgotten. The token of the link is returned.
+// 	token, err := myUserModel.requestEmailChange("new@example.com", time.Now())
+func (u UserModel) requestEmailChange(newEmail string, now time.Time) (string, error) {
+	if isEmailTaken(newEmail, u) {
+		return "", ErrEmailTaken
+	}
+	db := common.GetDB()
+	token := common.RandToken(emailChangeTokenBytes)
+	emailChangeModel := EmailChangeModel{
+		UserModelID: u.ID,
+		NewEmail:    newEmail,
+		TokenHash:   emailChangeTokenHash(token),
+		ExpiresAt:   now.Add(EmailChangeTTL),
+	}
+	tx := db.Begin()
+	if err := tx.Unscoped().Where(EmailChangeModel{UserModelID: u.ID}).Delete(EmailChangeModel{}).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Create(&emailChangeModel).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return "", err
+	}
+
+	err := common.DefaultMailer.Send(common.Mail{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen this link to use this address for your account:\n%s%s\n\n"+
+			"The link expires on %s.\n", u.Username, EmailConfirmURL, token, emailChangeModel.ExpiresAt.UTC().Format(time.RFC1123)),
+	})
+	if err == nil {
+		err = common.DefaultMailer.Send(common.Mail{
+			To:      u.Email,
+			Subject: "Your email address is being changed",
+			Body: fmt.Sprintf("Hello %s,\n\nSomebody asked to change the email address of your account to %s.\n"+
+				"If it wasn't you, change your password now: the change is only applied once the new address is confirmed.\n",
+				u.Username, newEmail),
+		})
+	}
+	if err != nil {
+		db.Unscoped().Delete(&emailChangeModel)
+		return "", err
+	}
+	return token, nil
+}
+
+// You could apply the email change of a verification token, gorm.ErrRecordNotFound means the token is unknown
+// or expired. ErrEmailTaken is returned when another user took the address in the meantime.
+// 	userModel, err := confirmEmailChange(token, time.Now())
+func confirmEmailChange(token string, now time.Time) (UserModel, error) {
+	db := common.GetDB()
+	var emailChangeModel EmailChangeModel
+	if token == "" {
+		return UserModel{}, gorm.ErrRecordNotFound
+	}
+	err := db.Where(EmailChangeModel{TokenHash: emailChangeTokenHash(token)}).First(&emailChangeModel).Error
+	if err != nil {
+		return UserModel{}, err
+	}
+	if !now.Before(emailChangeModel.ExpiresAt) {
+		db.Unscoped().Delete(&emailChangeModel)
+		return UserModel{}, gorm.ErrRecordNotFound
+	}
+	userModel, err := FindOneUser(&UserModel{ID: emailChangeModel.UserModelID})
+	if err != nil {
+		return userModel, err
+	}
+	if isEmailTaken(emailChangeModel.NewEmail, userModel) {
+		return userModel, ErrEmailTaken
+	}
+
+	tx := db.Begin()
+	err = tx.Model(&userModel).Update("email", emailChangeModel.NewEmail).Error
+	if common.IsUniqueViolation(err) {
+		tx.Rollback()
+		return userModel, ErrEmailTaken
+	}
+	if err == nil {
+		err = tx.Unscoped().Where(EmailChangeModel{UserModelID: userModel.ID}).Delete(EmailChangeModel{}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return userModel, err
+	}
+	return userModel, tx.Commit().Error
+}
+
+// The email a user asked to change to and hasn't confirmed yet, empty when there is none.
+func (u UserModel) pendingEmail(now time.Time) string {
+	db := common.GetDB()
+	var emailChangeModel EmailChangeModel
+	db.Where("user_model_id = ? AND expires_at > ?", u.ID, now).First(&emailChangeModel)
+	return emailChangeModel.NewEmail
+}
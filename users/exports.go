@@ -0,0 +1,238 @@
+package users
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// A personal data export of a user, the archive is built in background and removed once it expired.
+// Path is the key of the archive in common.MediaStorage.
+type ExportModel struct {
+	gorm.Model
+	UserModel   UserModel
+	UserModelID uint
+	Status      string
+	Path        string
+	ExpiresAt   time.Time
+}
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// How long the archives can be downloaded, and how long a download link given to the user works.
+var (
+	ExportTTL     = 24 * time.Hour
+	ExportLinkTTL = 15 * time.Minute
+)
+
+// An ExportSection returns the files another module keeps about a user, keyed by their path in the archive.
+type ExportSection func(userModel UserModel) (map[string][]byte, error)
+
+var exportSections = []ExportSection{exportProfile, exportSecurityEvents}
+
+// Modules depending on users add their data to the exports here.
+// 	users.RegisterExportSection(articles.ExportUserContent)
+func RegisterExportSection(section ExportSection) {
+	exportSections = append(exportSections, section)
+}
+
+// The profile and the following relationships of the user.
+func exportProfile(u UserModel) (map[string][]byte, error) {
+	var invitedBy *string
+	if inviter, err := u.invitedBy(); err == nil {
+		invitedBy = &inviter.Username
+	}
+	profile, err := json.MarshalIndent(map[string]interface{}{
+		"username":          u.Username,
+		"email":             u.Email,
+		"bio":               u.Bio,
+		"image":             u.Image,
+		"website":           u.Website,
+		"location":          u.Location,
+		"pronouns":          u.Pronouns,
+		"socialLinks":       u.socialLinks(),
+		"role":              u.Role,
+		"previousUsernames": u.previousUsernames(),
+		"invitedBy":         invitedBy,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	db := common.GetDB()
+	following, followers := []string{}, []string{}
+	err = db.Model(&UserModel{}).Joins("JOIN follow_models ON follow_models.following_id = user_models.id").
+		Where("follow_models.followed_by_id = ? AND follow_models.deleted_at IS NULL", u.ID).Pluck("username", &following).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&UserModel{}).Joins("JOIN follow_models ON follow_models.followed_by_id = user_models.id").
+		Where("follow_models.following_id = ? AND follow_models.deleted_at IS NULL", u.ID).Pluck("username", &followers).Error
+	if err != nil {
+		return nil, err
+	}
+	follows, err := json.MarshalIndent(map[string][]string{
+		"following": following,
+		"followers": followers,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{"profile.json": profile, "follows.json": follows}, nil
+}
+
+var ErrExportPending = errors.New("An export is already being built")
+
+// You could request an export of everything tied to a user, the archive is built in a goroutine.
+// A user has at most one pending export, ErrExportPending is returned until it is built or expired.
+// 	exportModel, err := RequestExport(userModel)
+func RequestExport(u UserModel) (ExportModel, error) {
+	db := common.GetDB()
+	now := time.Now()
+	exportModel := ExportModel{
+		UserModelID: u.ID,
+		Status:      ExportPending,
+		ExpiresAt:   now.Add(ExportTTL),
+	}
+	tx := db.Begin()
+	var pending int
+	err := tx.Model(&ExportModel{}).Where("user_model_id = ? AND status = ? AND expires_at > ?", u.ID, ExportPending, now).
+		Count(&pending).Error
+	if err == nil && pending > 0 {
+		err = ErrExportPending
+	}
+	if err == nil {
+		err = tx.Create(&exportModel).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return exportModel, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return exportModel, err
+	}
+	go func() {
+		if err := buildExport(exportModel, u); err != nil {
+			log.Printf("export %d of user %d failed: %v", exportModel.ID, u.ID, err)
+		}
+	}()
+	return exportModel, nil
+}
+
+func buildExport(exportModel ExportModel, u UserModel) error {
+	db := common.GetDB()
+	path, err := writeExportArchive(exportModel, u)
+	if err != nil {
+		db.Model(&exportModel).Update(ExportModel{Status: ExportFailed})
+		return err
+	}
+	return db.Model(&exportModel).Update(ExportModel{Status: ExportReady, Path: path}).Error
+}
+
+func writeExportArchive(exportModel ExportModel, u UserModel) (string, error) {
+	files := make(map[string][]byte)
+	for _, section := range exportSections {
+		sectionFiles, err := section(u)
+		if err != nil {
+			return "", err
+		}
+		for name, content := range sectionFiles {
+			files[name] = content
+		}
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: exportModel.CreatedAt})
+		if err == nil {
+			_, err = writer.Write(files[name])
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("exports/%d-%s.zip", exportModel.ID, common.RandString(16))
+	return key, common.MediaStorage.Put(key, &buf, "application/zip")
+}
+
+// You could get an export of a user, exports of other users and the id 0 are not found.
+// 	exportModel, err := FindOneExport(userModel, id)
+func FindOneExport(u UserModel, id uint) (ExportModel, error) {
+	var exportModel ExportModel
+	if id == 0 || u.ID == 0 {
+		return exportModel, gorm.ErrRecordNotFound
+	}
+	db := common.GetDB()
+	err := db.Where("id = ? AND user_model_id = ?", id, u.ID).First(&exportModel).Error
+	return exportModel, err
+}
+
+func (exportModel ExportModel) expired(now time.Time) bool {
+	return !now.Before(exportModel.ExpiresAt)
+}
+
+// Remove the archives and the records of every export of a user, used when the account is deleted.
+func deleteExports(tx *gorm.DB, u UserModel) ([]string, error) {
+	var exportModels []ExportModel
+	if err := tx.Unscoped().Where(&ExportModel{UserModelID: u.ID}).Find(&exportModels).Error; err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, exportModel := range exportModels {
+		if exportModel.Path != "" {
+			keys = append(keys, exportModel.Path)
+		}
+	}
+	return keys, tx.Unscoped().Where(&ExportModel{UserModelID: u.ID}).Delete(ExportModel{}).Error
+}
+
+// Remove the archives and the records of every export expired before now.
+func PurgeExpiredExports(now time.Time) error {
+	db := common.GetDB()
+	var exportModels []ExportModel
+	if err := db.Unscoped().Where("expires_at <= ?", now).Find(&exportModels).Error; err != nil {
+		return err
+	}
+	for _, exportModel := range exportModels {
+		if exportModel.Path != "" {
+			if err := common.MediaStorage.Delete(exportModel.Path); err != nil {
+				return err
+			}
+		}
+		if err := db.Unscoped().Delete(&exportModel).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge the expired exports every interval until the process exits.
+// 	go users.StartExportJanitor(time.Hour)
+func StartExportJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := PurgeExpiredExports(time.Now()); err != nil {
+			log.Printf("purge expired exports: %v", err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A PasswordHasher turns a password into a self-describing hash string,
+// the algorithm and its parameters are encoded in the hash so it can be verified after the configuration changed.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Recognizes tells whether hash was produced by the algorithm of this hasher.
+	Recognizes(hash string) bool
+	// Compare returns nil when password matches hash.
+	Compare(hash, password string) error
+	// NeedsRehash tells whether hash uses other parameters than the hasher does.
+	NeedsRehash(hash string) bool
+}
+
+var (
+	ErrUnknownPasswordHash = errors.New("unknown password hash algorithm")
+	ErrPasswordMismatch    = errors.New("password does not match the hash")
+)
+
+// The hasher used for new passwords. Passwords hashed by any hasher of KnownPasswordHashers can still be checked,
+// and they are rehashed with this one on the next successful login.
+var CurrentPasswordHasher PasswordHasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+
+var KnownPasswordHashers = []PasswordHasher{BcryptHasher{}, Argon2idHasher{}}
+
+// What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
+// Golang bcrypt doc: https://godoc.org/golang.org/x/crypto/bcrypt
+// Make sure the cost is between [4, 32), hashes look like "$2a$10$...".
+type BcryptHasher struct {
+	Cost int
+}
+
+// You could get a bcrypt hasher after checking its cost: bcrypt silently uses its default cost below
+// bcrypt.MinCost and fails above bcrypt.MaxCost, every login would rehash the password then.
+// 	hasher, err := NewBcryptHasher(12)
+func NewBcryptHasher(cost int) (BcryptHasher, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return BcryptHasher{}, fmt.Errorf("bcrypt cost should be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+	return BcryptHasher{Cost: cost}, nil
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+func (h BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h BcryptHasher) Compare(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+func (h BcryptHasher) NeedsRehash(hash string) bool {
+	if !h.Recognizes(hash) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.Cost
+}
+
+// Argon2id is the recommendation of https://github.com/P-H-C/phc-winner-argon2,
+// hashes use the PHC string format "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func NewArgon2idHasher() Argon2idHasher {
+	return Argon2idHasher{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// The bounds of the parameters read from a stored hash: argon2 panics on zero iterations or parallelism,
+// a huge memory would be allocated on every login and a short key would match too many passwords.
+const (
+	argon2idMaxMemory     = 4 * 1024 * 1024
+	argon2idMaxIterations = 64
+	argon2idMinSalt       = 8
+	argon2idMinKey        = 16
+	argon2idMaxKey        = 1024
+)
+
+var ErrInvalidPasswordHash = errors.New("password hash parameters out of range")
+
+func (h Argon2idHasher) inBounds() bool {
+	return h.Memory >= 8*uint32(h.Parallelism) && h.Memory <= argon2idMaxMemory &&
+		h.Iterations >= 1 && h.Iterations <= argon2idMaxIterations && h.Parallelism >= 1 &&
+		h.SaltLength >= argon2idMinSalt && h.KeyLength >= argon2idMinKey && h.KeyLength <= argon2idMaxKey
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+// decode reads the parameters, the salt and the key back from an encoded hash.
+func (h Argon2idHasher) decode(hash string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || !h.Recognizes(hash) {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	if !params.inBounds() {
+		return params, nil, nil, ErrInvalidPasswordHash
+	}
+	return params, salt, key, nil
+}
+
+func (h Argon2idHasher) Compare(hash, password string) error {
+	params, salt, key, err := h.decode(hash)
+	if err != nil {
+		return err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hash string) bool {
+	params, _, _, err := h.decode(hash)
+	return err != nil || params != h
+}
+
+// Find the hasher able to check an encoded hash.
+func passwordHasherFor(hash string) (PasswordHasher, error) {
+	for _, hasher := range KnownPasswordHashers {
+		if hasher.Recognizes(hash) {
+			return hasher, nil
+		}
+	}
+	return nil, ErrUnknownPasswordHash
+}
@@ -0,0 +1,201 @@
+package users
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The usernames and emails are compared through their canonical form: NFKC normalized, lower case and trimmed,
+// so "Bob@x.com" and "bob@x.com" are the same account. The canonical columns carry the unique indexes.
+func canonicalEmail(email string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(email)))
+}
+
+func canonicalUsername(username string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(username)))
+}
+
+// Characters looking like another one and their prototype, a subset of the TR39 confusables: the ASCII letters
+// and digits which look like another letter or a sequence of letters, and the Cyrillic and Greek letters which NFKC
+// leaves alone but look like Latin ones. See https://www.unicode.org/reports/tr39/#Confusable_Detection
+// The prototypes are never replaced themselves, so a skeleton doesn't change when it is computed again.
+var usernameConfusables = map[rune]string{
+	// ASCII
+	'0': "o", '1': "l", 'I': "l", 'm': "rn", 'w': "vv", 'd': "cl",
+	// Cyrillic
+	'А': "a", 'В': "b", 'Е': "e", 'К': "k", 'М': "rn", 'Н': "h", 'О': "o", 'Р': "p", 'С': "c", 'Т': "t", 'Х': "x",
+	'Ѕ': "s", 'І': "l", 'Ј': "j", 'а': "a", 'е': "e", 'о': "o", 'р': "p", 'с': "c", 'у': "y", 'х': "x", 'ѕ': "s",
+	'і': "i", 'ј': "j", 'ԁ': "cl", 'һ': "h", 'ԛ': "q", 'ԝ': "vv", 'ѵ': "v",
+	// Greek
+	'Α': "a", 'Β': "b", 'Ε': "e", 'Ζ': "z", 'Η': "h", 'Ι': "l", 'Κ': "k", 'Μ': "rn", 'Ν': "n", 'Ο': "o", 'Ρ': "p",
+	'Τ': "t", 'Υ': "y", 'Χ': "x", 'α': "a", 'ι': "i", 'ν': "v", 'ο': "o", 'ρ': "p",
+}
+
+func replaceConfusables(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if prototype, ok := usernameConfusables[r]; ok {
+			b.WriteString(prototype)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// The skeleton of a username: its normalized form without accents, the confusable characters replaced by their
+// prototype, in lower case. They are replaced before lowercasing so that "USERI" looks like "userl" but not "useri",
+// and again after it for the upper case letters whose lower case looks like a sequence, like the "M" of "rn".
+// Two usernames with the same skeleton look alike, only the first one can be taken.
+// 	usernameSkeleton("Wi11iam") // "vvilliarn"
+func usernameSkeleton(username string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(norm.NFKC.String(strings.TrimSpace(username))) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+	return replaceConfusables(strings.ToLower(replaceConfusables(b.String())))
+}
+
+// Keep the canonical columns in sync with the username and the email, whatever the way the user is saved.
+// On an update only the columns of the updated fields are touched, the model may not hold the other ones.
+func (u *UserModel) BeforeSave(scope *gorm.Scope) error {
+	attrs, updating := scope.InstanceGet("gorm:update_attrs")
+	updated := func(column string) bool {
+		if !updating {
+			return true
+		}
+		_, ok := attrs.(map[string]interface{})[column]
+		return ok
+	}
+	if updated("username") {
+		scope.SetColumn("UsernameCanonical", canonicalUsername(u.Username))
+		scope.SetColumn("UsernameSkeleton", usernameSkeleton(u.Username))
+	}
+	if updated("email") {
+		scope.SetColumn("EmailCanonical", canonicalEmail(u.Email))
+	}
+	return nil
+}
+
+// You could find a user by its email, the case doesn't matter.
+// 	userModel, err := FindOneUserByEmail("Username0@example.com")
+func FindOneUserByEmail(email string) (UserModel, error) {
+	if canonicalEmail(email) == "" {
+		return UserModel{}, gorm.ErrRecordNotFound
+	}
+	return FindOneUser(&UserModel{EmailCanonical: canonicalEmail(email)})
+}
+
+// You could check whether the username of another user than u is the same once canonicalized.
+func isUsernameTaken(username string, u UserModel) bool {
+	db := common.GetDB()
+	var count int
+	db.Model(&UserModel{}).Where("username_canonical = ? AND id <> ?", canonicalUsername(username), u.ID).Count(&count)
+	return count > 0
+}
+
+// You could check whether the username of another user than u looks like username.
+// 	if isUsernameConfusable("userI", myUserModel) { ... }
+func isUsernameConfusable(username string, u UserModel) bool {
+	db := common.GetDB()
+	var count int
+	db.Model(&UserModel{}).Where("username_skeleton = ? AND id <> ?", usernameSkeleton(username), u.ID).Count(&count)
+	return count > 0
+}
+
+// You could check a username before giving it to u, it returns a common.FieldError on "Username"
+// when it looks like the username of another user, the exact duplicates are left to the unique index.
+func validateUsername(username string, u UserModel) error {
+	if !isUsernameTaken(username, u) && isUsernameConfusable(username, u) {
+		return common.FieldError{Field: "Username", Message: "{key: confusable}"}
+	}
+	return nil
+}
+
+// Users whose usernames or emails are the same once canonicalized, one of them has to be renamed by hand
+// before the unique indexes can be created.
+type IdentityCollision struct {
+	Column    string
+	Canonical string
+	UserIDs   []uint
+}
+
+var ErrUsernameTaken = errors.New("Username is already taken")
+
+const (
+	usernameCanonicalIndex = "uix_user_models_username_canonical"
+	emailCanonicalIndex    = "uix_user_models_email_canonical"
+)
+
+// Fill the canonical columns of the existing users and create their unique indexes. The indexes are not created
+// while there are collisions, they are returned so that they can be solved before migrating again.
+// 	collisions, err := MigrateCanonicalIdentities()
+func MigrateCanonicalIdentities() ([]IdentityCollision, error) {
+	db := common.GetDB()
+	var userModels []UserModel
+	if err := db.Select("id, username, email, username_canonical, username_skeleton, email_canonical").Order("id").
+		Find(&userModels).Error; err != nil {
+		return nil, err
+	}
+	usernames := map[string][]uint{}
+	emails := map[string][]uint{}
+	for _, userModel := range userModels {
+		username, skeleton, email := canonicalUsername(userModel.Username), usernameSkeleton(userModel.Username), canonicalEmail(userModel.Email)
+		usernames[username] = append(usernames[username], userModel.ID)
+		emails[email] = append(emails[email], userModel.ID)
+		if userModel.UsernameCanonical == username && userModel.UsernameSkeleton == skeleton && userModel.EmailCanonical == email {
+			continue
+		}
+		err := db.Model(&UserModel{}).Where("id = ?", userModel.ID).UpdateColumns(map[string]interface{}{
+			"username_canonical": username,
+			"username_skeleton":  skeleton,
+			"email_canonical":    email,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := migrateUsernameHistorySkeletons(db); err != nil {
+		return nil, err
+	}
+
+	var collisions []IdentityCollision
+	for _, column := range []struct {
+		name   string
+		values map[string][]uint
+		index  string
+	}{
+		{"username", usernames, usernameCanonicalIndex},
+		{"email", emails, emailCanonicalIndex},
+	} {
+		found := false
+		for canonical, ids := range column.values {
+			if len(ids) > 1 {
+				collisions = append(collisions, IdentityCollision{Column: column.name, Canonical: canonical, UserIDs: ids})
+				found = true
+			}
+		}
+		if found || db.Dialect().HasIndex(db.NewScope(&UserModel{}).TableName(), column.index) {
+			continue
+		}
+		if err := db.Model(&UserModel{}).AddUniqueIndex(column.index, column.name+"_canonical").Error; err != nil {
+			return collisions, err
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		if collisions[i].Column != collisions[j].Column {
+			return collisions[i].Column > collisions[j].Column
+		}
+		return collisions[i].Canonical < collisions[j].Canonical
+	})
+	return collisions, nil
+}
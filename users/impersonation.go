@@ -0,0 +1,80 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// How long an impersonation token works, support should ask for a new one rather than keep it around.
+var ImpersonationTTL = 15 * time.Minute
+
+var ErrImpersonationNotAllowed = errors.New("Not allowed while impersonating")
+
+// An impersonation is only meant to see what the user sees, the requests changing anything are refused.
+func impersonationAllows(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// You could let the admin actor act as subject, the returned token carries both of them.
+// Admins can't be impersonated: it would give the rights of another admin.
+// 	token, expiresAt, err := startImpersonation(myUserModel, userModel, time.Now())
+func startImpersonation(actor UserModel, subject UserModel, now time.Time) (string, time.Time, error) {
+	if actor.Role != RoleAdmin || subject.ID == actor.ID || subject.Role == RoleAdmin {
+		return "", time.Time{}, common.FieldError{Field: "Username", Message: "{key: impersonation}"}
+	}
+	expiresAt := now.Add(ImpersonationTTL)
+	return common.GenImpersonationToken(subject.ID, actor.ID, ImpersonationTTL), expiresAt, nil
+}
+
+// Check the actor of an impersonation token and remember it in the context, it returns false when the actor
+// isn't an admin anymore or revoked its tokens since iat.
+func setImpersonator(c *gin.Context, actorID uint, iat int64, token string) bool {
+	var actor UserModel
+	common.GetDB().First(&actor, actorID)
+	if actor.ID == 0 || actor.Role != RoleAdmin || actor.tokenRevoked(iat) {
+		return false
+	}
+	c.Set("impersonator_model", actor)
+	c.Set("impersonation_token", token)
+	return true
+}
+
+// The admin behind the request when it is made with an impersonation token, my_user_model being the subject.
+// 	if actor, ok := Impersonator(c); ok { ... }
+func Impersonator(c *gin.Context) (UserModel, bool) {
+	actor, ok := c.Get("impersonator_model")
+	if !ok || actor.(UserModel).ID == 0 {
+		return UserModel{}, false
+	}
+	return actor.(UserModel), true
+}
+
+// Log every request made with an impersonation token once, even though AuthMiddleware runs twice on the
+// authenticated routes, with the status of the response.
+func auditImpersonatedRequest(c *gin.Context) {
+	if _, ok := Impersonator(c); !ok || c.GetBool("impersonation_audited") {
+		return
+	}
+	c.Set("impersonation_audited", true)
+	subject := c.MustGet("my_user_model").(UserModel)
+	c.Next()
+	RecordSecurityEvent(c, EventImpersonatedRequest, subject, map[string]interface{}{
+		"method": c.Request.Method,
+		"path":   c.Request.URL.Path,
+		"status": c.Writer.Status(),
+	})
+}
+
+// Refuse the request with a 403 when it is made with an impersonation token, it returns true when refused.
+// 	if forbidImpersonation(c) { return }
+func forbidImpersonation(c *gin.Context) bool {
+	if _, ok := Impersonator(c); !ok {
+		return false
+	}
+	c.JSON(http.StatusForbidden, common.NewError("user", ErrImpersonationNotAllowed))
+	return true
+}
@@ -0,0 +1,217 @@
+package users
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// Who may sign up: everybody, only the holders of an invitation code, or nobody.
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var RegistrationMode = RegistrationOpen
+
+var ErrRegistrationClosed = errors.New("Registration is closed")
+
+// An invitation code created by a user, it can be redeemed MaxUses times (0 is unlimited) until ExpiresAt (nil never expires).
+// Revoking an invitation soft deletes it, its redemptions are kept.
+type InvitationModel struct {
+	gorm.Model
+	Code        string `gorm:"unique_index"`
+	CreatedBy   UserModel
+	CreatedByID uint
+	MaxUses     int
+	Uses        int
+	ExpiresAt   *time.Time
+}
+
+// A user who signed up with an invitation, so we know who invited whom.
+type InvitationRedemptionModel struct {
+	gorm.Model
+	Invitation   InvitationModel
+	InvitationID uint
+	UserModel    UserModel
+	UserModelID  uint `gorm:"unique_index"`
+}
+
+// The limits of the invitations created by the users who are not admins.
+// Their invitations expire after InvitationTTL unless they choose an earlier date,
+// and they can create InvitationQuota of them per InvitationQuotaPeriod, the revoked ones included.
+var (
+	InvitationTTL         = 7 * 24 * time.Hour
+	InvitationMaxTTL      = 30 * 24 * time.Hour
+	InvitationMaxUses     = 5
+	InvitationQuota       = 10
+	InvitationQuotaPeriod = 30 * 24 * time.Hour
+)
+
+var ErrInvitationQuota = errors.New("Too many invitations, try again later")
+
+const invitationCodeBytes = 8
+
+// You could create an invitation code, the admins choose any limits, the other users get the ones above.
+// It returns a common.FieldError on "MaxUses" or "ExpiresAt" when the limits are not allowed,
+// ErrInvitationQuota when the user already created InvitationQuota invitations recently.
+// 	invitationModel, err := newInvitation(myUserModel, 1, nil, time.Now())
+func newInvitation(u UserModel, maxUses int, expiresAt *time.Time, now time.Time) (InvitationModel, error) {
+	if maxUses < 0 {
+		return InvitationModel{}, common.FieldError{Field: "MaxUses", Message: "{min: 0}"}
+	}
+	if expiresAt != nil && !expiresAt.After(now) {
+		return InvitationModel{}, common.FieldError{Field: "ExpiresAt", Message: "{key: future}"}
+	}
+	if u.Role != RoleAdmin {
+		if maxUses == 0 {
+			maxUses = 1
+		}
+		if maxUses > InvitationMaxUses {
+			return InvitationModel{}, common.FieldError{Field: "MaxUses", Message: "{max: " + strconv.Itoa(InvitationMaxUses) + "}"}
+		}
+		if expiresAt == nil {
+			t := now.Add(InvitationTTL)
+			expiresAt = &t
+		} else if expiresAt.After(now.Add(InvitationMaxTTL)) {
+			return InvitationModel{}, common.FieldError{Field: "ExpiresAt", Message: "{max: " + now.Add(InvitationMaxTTL).UTC().Format(time.RFC3339) + "}"}
+		}
+	}
+	db := common.GetDB()
+	invitationModel := InvitationModel{
+		Model:       gorm.Model{CreatedAt: now},
+		Code:        common.RandToken(invitationCodeBytes),
+		CreatedByID: u.ID,
+		MaxUses:     maxUses,
+		ExpiresAt:   expiresAt,
+	}
+	tx := db.Begin()
+	if u.Role != RoleAdmin {
+		var count int
+		err := tx.Unscoped().Model(&InvitationModel{}).Where("created_by_id = ? AND created_at > ?", u.ID, now.Add(-InvitationQuotaPeriod)).
+			Count(&count).Error
+		if err == nil && count >= InvitationQuota {
+			err = ErrInvitationQuota
+		}
+		if err != nil {
+			tx.Rollback()
+			return InvitationModel{}, err
+		}
+	}
+	if err := tx.Create(&invitationModel).Error; err != nil {
+		tx.Rollback()
+		return invitationModel, err
+	}
+	return invitationModel, tx.Commit().Error
+}
+
+// You could list the invitations created by a user, the most recent first.
+// 	invitationModels, err := myUserModel.GetInvitations()
+func (u UserModel) GetInvitations() ([]InvitationModel, error) {
+	db := common.GetDB()
+	var invitationModels []InvitationModel
+	err := db.Where(InvitationModel{CreatedByID: u.ID}).Order("created_at DESC").Find(&invitationModels).Error
+	return invitationModels, err
+}
+
+// You could find an invitation which can be revoked by a user: one of its own, or any of them for an admin.
+// 	invitationModel, err := FindOneInvitation(myUserModel, "xxxxxxxxxxxx")
+func FindOneInvitation(u UserModel, code string) (InvitationModel, error) {
+	db := common.GetDB()
+	var invitationModel InvitationModel
+	if code == "" {
+		return invitationModel, gorm.ErrRecordNotFound
+	}
+	query := db.Where(InvitationModel{Code: code})
+	if u.Role != RoleAdmin {
+		query = query.Where(InvitationModel{CreatedByID: u.ID})
+	}
+	err := query.First(&invitationModel).Error
+	return invitationModel, err
+}
+
+// The usernames of the users who signed up with an invitation, in the order they did.
+func (invitationModel InvitationModel) invitees() []string {
+	db := common.GetDB()
+	var usernames []string
+	db.Model(&UserModel{}).Joins("JOIN invitation_redemption_models ON invitation_redemption_models.user_model_id = user_models.id").
+		Where("invitation_redemption_models.invitation_id = ?", invitationModel.ID).
+		Order("invitation_redemption_models.created_at").Pluck("username", &usernames)
+	return append([]string{}, usernames...)
+}
+
+// You could find the user who invited u, gorm.ErrRecordNotFound means u was not invited.
+// 	inviter, err := myUserModel.invitedBy()
+func (u UserModel) invitedBy() (UserModel, error) {
+	db := common.GetDB()
+	var inviter UserModel
+	err := db.Joins("JOIN invitation_models ON invitation_models.created_by_id = user_models.id").
+		Joins("JOIN invitation_redemption_models ON invitation_redemption_models.invitation_id = invitation_models.id").
+		Where("invitation_redemption_models.user_model_id = ?", u.ID).First(&inviter).Error
+	return inviter, err
+}
+
+// Count one more use of the invitation and remember u redeemed it. The uses are increased by a single
+// conditional update so two sign ups can't take the last use of an invitation at the same time.
+func redeemInvitation(tx *gorm.DB, u UserModel, code string, now time.Time) error {
+	var invitationModel InvitationModel
+	err := tx.Where(InvitationModel{Code: code}).First(&invitationModel).Error
+	if gorm.IsRecordNotFoundError(err) || code == "" {
+		return common.FieldError{Field: "InvitationCode", Message: "{key: invalid}"}
+	} else if err != nil {
+		return err
+	}
+	if invitationModel.ExpiresAt != nil && !now.Before(*invitationModel.ExpiresAt) {
+		return common.FieldError{Field: "InvitationCode", Message: "{key: expired}"}
+	}
+	res := tx.Model(&InvitationModel{}).Where("id = ? AND (max_uses = 0 OR uses < max_uses)", invitationModel.ID).
+		UpdateColumn("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return common.FieldError{Field: "InvitationCode", Message: "{key: used}"}
+	}
+	return tx.Create(&InvitationRedemptionModel{InvitationID: invitationModel.ID, UserModelID: u.ID}).Error
+}
+
+// You could sign up a user according to RegistrationMode, the invitation code is redeemed when one is given,
+// even with RegistrationOpen. It returns ErrRegistrationClosed, or a common.FieldError on "InvitationCode".
+// 	err := registerUser(&userModel, "xxxxxxxxxxxx", time.Now())
+func registerUser(u *UserModel, code string, now time.Time) error {
+	if RegistrationMode == RegistrationClosed {
+		return ErrRegistrationClosed
+	}
+	if code == "" && RegistrationMode == RegistrationInvite {
+		return common.FieldError{Field: "InvitationCode", Message: "{key: required}"}
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Create(u).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if code != "" {
+		if err := redeemInvitation(tx, *u, code, now); err != nil {
+			tx.Rollback()
+			u.ID = 0
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// The invitations of a deleted user go away with their redemptions, and so does the redemption of the user.
+func deleteInvitations(tx *gorm.DB, u UserModel) error {
+	invitationIDs := tx.Unscoped().Model(&InvitationModel{}).Where("created_by_id = ?", u.ID).Select("id").QueryExpr()
+	err := tx.Unscoped().Where("user_model_id = ? OR invitation_id IN (?)", u.ID, invitationIDs).
+		Delete(InvitationRedemptionModel{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Where("created_by_id = ?", u.ID).Delete(InvitationModel{}).Error
+}
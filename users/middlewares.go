@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
@@ -48,6 +49,7 @@ func UpdateContextUserModel(c *gin.Context, my_user_id uint) {
 func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		UpdateContextUserModel(c, 0)
+		c.Set("impersonator_model", UserModel{})
 		token, err := request.ParseFromRequest(c.Request, MyAuth2Extractor, func(token *jwt.Token) (interface{}, error) {
 			b := ([]byte(common.NBSecretPassword))
 			return b, nil
@@ -62,6 +64,43 @@ func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 			my_user_id := uint(claims["id"].(float64))
 			//fmt.Println(my_user_id,claims["id"])
 			UpdateContextUserModel(c, my_user_id)
+			// The tokens made before iat existed count as issued at the epoch, so any revocation covers them.
+			iat, _ := claims["iat"].(float64)
+			revoked := c.MustGet("my_user_model").(UserModel).tokenRevoked(int64(iat))
+			if act, ok := claims["act"].(float64); ok && !revoked {
+				revoked = !setImpersonator(c, uint(act), int64(iat), token.Raw)
+			}
+			if revoked {
+				UpdateContextUserModel(c, 0)
+				if auto401 {
+					c.AbortWithStatus(http.StatusUnauthorized)
+				}
+				return
+			}
+			// The impersonation tokens are read-only, the refused requests are audited as well.
+			if _, ok := Impersonator(c); ok && !impersonationAllows(c.Request.Method) {
+				c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("user", ErrImpersonationNotAllowed))
+			}
+			auditImpersonatedRequest(c)
+		}
+	}
+}
+
+// Only let the users with one of the roles through, mount it after AuthMiddleware(true).
+// The impersonation tokens never get through, whoever the subject is.
+//  admin.Use(users.RequireRole(users.RoleAdmin))
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if _, ok := Impersonator(c); ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("user", ErrImpersonationNotAllowed))
+			return
+		}
+		for _, role := range roles {
+			if myUserModel.ID != 0 && myUserModel.Role == role {
+				return
+			}
 		}
+		c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("user", errors.New("Not allowed")))
 	}
 }
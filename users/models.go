@@ -1,10 +1,15 @@
 package users
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
+	"log"
+	"strings"
+	"time"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Models should only be concerned with database schema, more strict checking should be put in validator.
@@ -13,12 +18,109 @@ import (
 //
 // HINT: If you want to split null and "", you should use *string instead of string.
 type UserModel struct {
-	ID           uint    `gorm:"primary_key"`
-	Username     string  `gorm:"column:username"`
-	Email        string  `gorm:"column:email;unique_index"`
-	Bio          string  `gorm:"column:bio;size:1024"`
-	Image        *string `gorm:"column:image"`
-	PasswordHash string  `gorm:"column:password;not null"`
+	ID           uint        `gorm:"primary_key"`
+	Username     string      `gorm:"column:username"`
+	Email        string      `gorm:"column:email;unique_index"`
+	Bio          string      `gorm:"column:bio;size:1024"`
+	Image        *string     `gorm:"column:image"`
+	PasswordHash string      `gorm:"column:password;not null"`
+	Role         string      `gorm:"column:role"`
+	Private      bool        `gorm:"column:private"`
+	AvatarKey    string      `gorm:"column:avatar_key"`
+	Website      string      `gorm:"column:website"`
+	Location     string      `gorm:"column:location"`
+	Pronouns     string      `gorm:"column:pronouns"`
+	SocialLinks  SocialLinks `gorm:"column:social_links;type:text"`
+	// Filled in BeforeSave, see identities.go. Their unique indexes are created by MigrateCanonicalIdentities.
+	UsernameCanonical string `gorm:"column:username_canonical"`
+	UsernameSkeleton  string `gorm:"column:username_skeleton;index"`
+	EmailCanonical    string `gorm:"column:email_canonical"`
+	// The tokens issued before are refused by AuthMiddleware.
+	TokensRevokedAt *time.Time `gorm:"column:tokens_revoked_at"`
+}
+
+// The social links of a profile, kept as a JSON array in a single column.
+type SocialLinks []string
+
+func (links SocialLinks) Value() (driver.Value, error) {
+	if links == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(links))
+	return string(data), err
+}
+
+func (links *SocialLinks) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("unsupported social links value %T", value)
+	}
+	// An empty list is read back as nil, the same as a UserModel which was never saved.
+	*links = nil
+	var list []string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+	}
+	if len(list) > 0 {
+		*links = list
+	}
+	return nil
+}
+
+// The social links as an always non-nil list for the responses.
+func (u UserModel) socialLinks() []string {
+	return append([]string{}, u.SocialLinks...)
+}
+
+// Roles granting extra permissions, an empty Role is a regular user.
+const (
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Moderators and admins are allowed to manage content created by other users.
+// 	if myUserModel.IsModerator() { ... }
+func (u UserModel) IsModerator() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
+}
+
+// You could give a role to a user, an empty role makes it a regular user again.
+// 	err := userModel.setRole(RoleModerator)
+func (u *UserModel) setRole(role string) error {
+	switch role {
+	case "", RoleModerator, RoleAdmin:
+	default:
+		return common.FieldError{Field: "Role", Message: "{key: oneof}"}
+	}
+	return u.Update(map[string]interface{}{"role": role})
+}
+
+// You could give a role to the user named username from the configuration, when the server starts.
+// The change is in the audit log without an actor, nothing happens when the user already has the role.
+// 	err := users.EnsureRole("wangzitian0", users.RoleModerator)
+func EnsureRole(username string, role string) error {
+	userModel, _, err := FindOneUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if userModel.Role == role {
+		return nil
+	}
+	previousRole := userModel.Role
+	if err := userModel.setRole(role); err != nil {
+		return err
+	}
+	recordSecurityEvent(SecurityEventModel{UserModelID: userModel.ID, Type: EventRoleChanged},
+		map[string]interface{}{"from": previousRole, "to": role, "source": "configuration"})
+	return nil
 }
 
 // A hack way to save ManyToMany relationship,
@@ -39,35 +141,98 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// A pending request of Requester to follow Target, only private users receive them.
+// Once Target approves it, the request becomes a FollowModel.
+type FollowRequestModel struct {
+	gorm.Model
+	Requester   UserModel
+	RequesterID uint
+	Target      UserModel
+	TargetID    uint
+}
+
+// Blocker doesn't want anything to do with Blocked: they can't follow each other, comment on or favorite
+// the articles of each other, and their content is hidden from each other.
+type BlockModel struct {
+	gorm.Model
+	Blocker   UserModel
+	BlockerID uint
+	Blocked   UserModel
+	BlockedID uint
+}
+
+// Muter doesn't want to see the articles and comments of Muted anymore, Muted isn't affected at all.
+type MuteModel struct {
+	gorm.Model
+	Muter   UserModel
+	MuterID uint
+	Muted   UserModel
+	MutedID uint
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&LoginAttemptModel{})
+	db.AutoMigrate(&ExportModel{})
+	db.AutoMigrate(&BlockModel{})
+	db.AutoMigrate(&MuteModel{})
+	db.AutoMigrate(&FollowRequestModel{})
+	db.AutoMigrate(&UsernameHistoryModel{})
+	db.AutoMigrate(&InvitationModel{})
+	db.AutoMigrate(&InvitationRedemptionModel{})
+	db.AutoMigrate(&EmailChangeModel{})
+	db.AutoMigrate(&SecurityEventModel{})
+
+	collisions, err := MigrateCanonicalIdentities()
+	if err != nil {
+		log.Printf("migrate canonical identities: %v", err)
+	}
+	for _, collision := range collisions {
+		log.Printf("migrate canonical identities: users %v share the %s %q, rename all of them but one and migrate again",
+			collision.UserIDs, collision.Column, collision.Canonical)
+	}
 }
 
-// What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
-// Golang bcrypt doc: https://godoc.org/golang.org/x/crypto/bcrypt
-// You can change the value in bcrypt.DefaultCost to adjust the security index.
+// The password is hashed by CurrentPasswordHasher, see hashers.go to choose between bcrypt and argon2id.
 // 	err := userModel.setPassword("password0")
 func (u *UserModel) setPassword(password string) error {
 	if len(password) == 0 {
 		return errors.New("password should not be empty!")
 	}
-	bytePassword := []byte(password)
-	// Make sure the second param `bcrypt generator cost` between [4, 32)
-	passwordHash, _ := bcrypt.GenerateFromPassword(bytePassword, bcrypt.DefaultCost)
-	u.PasswordHash = string(passwordHash)
+	passwordHash, err := CurrentPasswordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = passwordHash
 	return nil
 }
 
 // Database will only save the hashed string, you should check it by util function.
 // 	if err := serModel.checkPassword("password0"); err != nil { password error }
 func (u *UserModel) checkPassword(password string) error {
-	bytePassword := []byte(password)
-	byteHashedPassword := []byte(u.PasswordHash)
-	return bcrypt.CompareHashAndPassword(byteHashedPassword, bytePassword)
+	hasher, err := passwordHasherFor(u.PasswordHash)
+	if err != nil {
+		return err
+	}
+	return hasher.Compare(u.PasswordHash, password)
+}
+
+// Rehash a correct password when the stored hash was made by another algorithm or with outdated parameters,
+// so raising the cost takes effect as users login.
+// 	if err := userModel.rehashPassword("password0"); err != nil { ... }
+func (u *UserModel) rehashPassword(password string) error {
+	if !CurrentPasswordHasher.NeedsRehash(u.PasswordHash) {
+		return nil
+	}
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	db := common.GetDB()
+	return db.Model(u).Update("password", u.PasswordHash).Error
 }
 
 // You could input the conditions and it will return an UserModel in database with error info.
@@ -95,6 +260,19 @@ func (model *UserModel) Update(data interface{}) error {
 	return err
 }
 
+// You could sign out a user everywhere, the tokens issued before now stop working.
+// The tokens carry their issue time in seconds, a token issued during the same second is still accepted.
+// 	err := myUserModel.revokeTokens(time.Now())
+func (u *UserModel) revokeTokens(now time.Time) error {
+	revokedAt := now.Truncate(time.Second)
+	return u.Update(map[string]interface{}{"tokens_revoked_at": &revokedAt})
+}
+
+// Whether a token issued at iat (in Unix seconds) was revoked.
+func (u UserModel) tokenRevoked(iat int64) bool {
+	return u.TokensRevokedAt != nil && iat < u.TokensRevokedAt.Unix()
+}
+
 // You could add a following relationship as userModel1 following userModel2
 // 	err = userModel1.following(userModel2)
 func (u UserModel) following(v UserModel) error {
@@ -110,6 +288,9 @@ func (u UserModel) following(v UserModel) error {
 // You could check whether  userModel1 following userModel2
 // 	followingBool = myUserModel.isFollowing(self.UserModel)
 func (u UserModel) isFollowing(v UserModel) bool {
+	if u.ID == 0 || v.ID == 0 {
+		return false
+	}
 	db := common.GetDB()
 	var follow FollowModel
 	db.Where(FollowModel{
@@ -127,7 +308,10 @@ func (u UserModel) unFollowing(v UserModel) error {
 		FollowingID:  v.ID,
 		FollowedByID: u.ID,
 	}).Delete(FollowModel{}).Error
-	return err
+	if err != nil {
+		return err
+	}
+	return u.cancelFollowRequest(v)
 }
 
 // You could get a following list of userModel
@@ -148,3 +332,432 @@ func (u UserModel) GetFollowings() []UserModel {
 	tx.Commit()
 	return followings
 }
+
+// An AccountDeletionHook deletes or anonymizes the data another module keeps about a user,
+// it runs inside the transaction of DeleteAccount so returning an error cancels the whole deletion.
+// The files of common.MediaStorage can't be rolled back, so the hook returns their keys instead of
+// deleting them, DeleteAccount removes them once the transaction is committed.
+type AccountDeletionHook func(tx *gorm.DB, userModel UserModel) (storageKeys []string, err error)
+
+var accountDeletionHooks []AccountDeletionHook
+
+// Modules depending on users register their cleanup here, e.g. the articles and comments of the user.
+// 	users.RegisterAccountDeletionHook(articles.DeleteUserContent)
+func RegisterAccountDeletionHook(hook AccountDeletionHook) {
+	accountDeletionHooks = append(accountDeletionHooks, hook)
+}
+
+// You could delete an account with every following, blocking and muting relationship of it, nothing is soft deleted
+// but its usernames, which stay reserved in the history.
+// The stored files (avatar, exports and whatever the hooks return) are removed only after the commit,
+// a failure to remove one is logged since the account is already gone.
+// 	err := DeleteAccount(userModel)
+func DeleteAccount(u UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	storageKeys := avatarFileKeys(u.AvatarKey)
+	for _, hook := range accountDeletionHooks {
+		keys, err := hook(tx, u)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		storageKeys = append(storageKeys, keys...)
+	}
+	err := tx.Unscoped().Where("following_id = ? OR followed_by_id = ?", u.ID, u.ID).Delete(FollowModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Unscoped().Where("requester_id = ? OR target_id = ?", u.ID, u.ID).Delete(FollowRequestModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Unscoped().Where("blocker_id = ? OR blocked_id = ?", u.ID, u.ID).Delete(&BlockModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Unscoped().Where("muter_id = ? OR muted_id = ?", u.ID, u.ID).Delete(&MuteModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := reserveUsernames(tx, u, time.Now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Unscoped().Where(EmailChangeModel{UserModelID: u.ID}).Delete(EmailChangeModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := deleteInvitations(tx, u); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Where(LoginAttemptModel{Key: emailThrottleKey(strings.ToLower(u.Email))}).Delete(LoginAttemptModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	exportKeys, err := deleteExports(tx, u)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	storageKeys = append(storageKeys, exportKeys...)
+	if err := tx.Delete(&u).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	for _, key := range storageKeys {
+		if err := common.MediaStorage.Delete(key); err != nil {
+			log.Printf("delete account %v: file %s not removed: %v", u.ID, key, err)
+		}
+	}
+	return nil
+}
+
+// You could get a page of the users following userModel, with the total count.
+// 	followers, count, err := userModel.GetFollowers(20, 0)
+func (u UserModel) GetFollowers(limit, offset int) ([]UserModel, int, error) {
+	db := common.GetDB()
+	var models []UserModel
+	var count int
+	query := db.Model(&UserModel{}).Joins("JOIN follow_models ON follow_models.followed_by_id = user_models.id").
+		Where("follow_models.following_id = ? AND follow_models.deleted_at IS NULL", u.ID)
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, err
+	}
+	err := query.Order("follow_models.id").Offset(offset).Limit(limit).Find(&models).Error
+	return models, count, err
+}
+
+// You could get a page of the users followed by userModel, with the total count.
+// 	followings, count, err := userModel.GetFollowingsPage(20, 0)
+func (u UserModel) GetFollowingsPage(limit, offset int) ([]UserModel, int, error) {
+	db := common.GetDB()
+	var models []UserModel
+	var count int
+	query := db.Model(&UserModel{}).Joins("JOIN follow_models ON follow_models.following_id = user_models.id").
+		Where("follow_models.followed_by_id = ? AND follow_models.deleted_at IS NULL", u.ID)
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, err
+	}
+	err := query.Order("follow_models.id").Offset(offset).Limit(limit).Find(&models).Error
+	return models, count, err
+}
+
+// What a viewer sees of other profiles: the relationships of the viewer with them and their follow counts.
+type profileRelations struct {
+	following, blocking, muting, requested map[uint]bool
+	followers, followings                  map[uint]int
+	// The profiles whose relations were loaded, used by PreloadProfiles.
+	loaded map[uint]bool
+}
+
+// You could load the relations of a whole page of profiles at once, a query per kind of relation.
+// 	relations := loadProfileRelations(myUserModel, []uint{1, 2, 3})
+func loadProfileRelations(viewer UserModel, ids []uint) (profileRelations, error) {
+	relations := profileRelations{
+		following:  map[uint]bool{},
+		blocking:   map[uint]bool{},
+		muting:     map[uint]bool{},
+		requested:  map[uint]bool{},
+		followers:  map[uint]int{},
+		followings: map[uint]int{},
+	}
+	if len(ids) == 0 {
+		return relations, nil
+	}
+	db := common.GetDB()
+	if viewer.ID != 0 {
+		for _, relation := range []struct {
+			model  interface{}
+			viewer string
+			other  string
+			found  map[uint]bool
+		}{
+			{&FollowModel{}, "followed_by_id", "following_id", relations.following},
+			{&BlockModel{}, "blocker_id", "blocked_id", relations.blocking},
+			{&MuteModel{}, "muter_id", "muted_id", relations.muting},
+			{&FollowRequestModel{}, "requester_id", "target_id", relations.requested},
+		} {
+			var others []uint
+			err := db.Model(relation.model).Where(relation.viewer+" = ? AND "+relation.other+" IN (?)", viewer.ID, ids).
+				Pluck(relation.other, &others).Error
+			if err != nil {
+				return relations, err
+			}
+			for _, id := range others {
+				relation.found[id] = true
+			}
+		}
+	}
+	for column, counts := range map[string]map[uint]int{"following_id": relations.followers, "followed_by_id": relations.followings} {
+		rows, err := db.Model(&FollowModel{}).Select(column+", count(*)").Where(column+" IN (?)", ids).Group(column).Rows()
+		if err != nil {
+			return relations, err
+		}
+		for rows.Next() {
+			var id uint
+			var count int
+			if err := rows.Scan(&id, &count); err != nil {
+				rows.Close()
+				return relations, err
+			}
+			counts[id] = count
+		}
+		rows.Close()
+	}
+	return relations, nil
+}
+
+// You could block userModel2 as userModel1, every following relationship between them is removed.
+// 	err = userModel1.block(userModel2)
+func (u UserModel) block(v UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	var block BlockModel
+	if err := tx.FirstOrCreate(&block, &BlockModel{BlockerID: u.ID, BlockedID: v.ID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Where("(following_id = ? AND followed_by_id = ?) OR (following_id = ? AND followed_by_id = ?)", u.ID, v.ID, v.ID, u.ID).
+		Delete(FollowModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Where("(requester_id = ? AND target_id = ?) OR (requester_id = ? AND target_id = ?)", u.ID, v.ID, v.ID, u.ID).
+		Delete(FollowRequestModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// 	err = userModel1.unBlock(userModel2)
+func (u UserModel) unBlock(v UserModel) error {
+	db := common.GetDB()
+	return db.Where(BlockModel{BlockerID: u.ID, BlockedID: v.ID}).Delete(BlockModel{}).Error
+}
+
+// 	blockingBool = myUserModel.isBlocking(self.UserModel)
+func (u UserModel) isBlocking(v UserModel) bool {
+	if u.ID == 0 || v.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var block BlockModel
+	db.Where(BlockModel{BlockerID: u.ID, BlockedID: v.ID}).First(&block)
+	return block.ID != 0
+}
+
+// You could check whether one of the two users blocked the other one.
+// 	if users.IsBlockedBetween(myUserModel, authorUserModel) { ... }
+func IsBlockedBetween(u, v UserModel) bool {
+	if u.ID == 0 || v.ID == 0 {
+		return false
+	}
+	return u.isBlocking(v) || v.isBlocking(u)
+}
+
+// 	err = userModel1.mute(userModel2)
+func (u UserModel) mute(v UserModel) error {
+	db := common.GetDB()
+	var mute MuteModel
+	return db.FirstOrCreate(&mute, &MuteModel{MuterID: u.ID, MutedID: v.ID}).Error
+}
+
+// 	err = userModel1.unMute(userModel2)
+func (u UserModel) unMute(v UserModel) error {
+	db := common.GetDB()
+	return db.Where(MuteModel{MuterID: u.ID, MutedID: v.ID}).Delete(MuteModel{}).Error
+}
+
+// 	mutingBool = myUserModel.isMuting(self.UserModel)
+func (u UserModel) isMuting(v UserModel) bool {
+	if u.ID == 0 || v.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var mute MuteModel
+	db.Where(MuteModel{MuterID: u.ID, MutedID: v.ID}).First(&mute)
+	return mute.ID != 0
+}
+
+// The IDs of the users blocked by userModel or blocking it.
+// 	ids := users.BlockedUserIDs(myUserModel)
+func BlockedUserIDs(u UserModel) []uint {
+	var ids []uint
+	if u.ID == 0 {
+		return ids
+	}
+	db := common.GetDB()
+	var blocks []BlockModel
+	db.Where("blocker_id = ? OR blocked_id = ?", u.ID, u.ID).Find(&blocks)
+	for _, block := range blocks {
+		if block.BlockerID == u.ID {
+			ids = append(ids, block.BlockedID)
+		} else {
+			ids = append(ids, block.BlockerID)
+		}
+	}
+	return ids
+}
+
+// The IDs of the users whose content should not be shown to userModel: the blocked and the muted ones.
+// 	ids := users.HiddenUserIDs(myUserModel)
+func HiddenUserIDs(u UserModel) []uint {
+	ids := BlockedUserIDs(u)
+	if u.ID == 0 {
+		return ids
+	}
+	db := common.GetDB()
+	var muted []uint
+	db.Model(&MuteModel{}).Where(MuteModel{MuterID: u.ID}).Pluck("muted_id", &muted)
+	return append(ids, muted...)
+}
+
+// You could ask a private userModel2 to be followed by userModel1.
+// 	err = userModel1.requestFollowing(userModel2)
+func (u UserModel) requestFollowing(v UserModel) error {
+	db := common.GetDB()
+	var request FollowRequestModel
+	return db.FirstOrCreate(&request, &FollowRequestModel{RequesterID: u.ID, TargetID: v.ID}).Error
+}
+
+// 	requestedBool = myUserModel.hasRequestedFollowing(self.UserModel)
+func (u UserModel) hasRequestedFollowing(v UserModel) bool {
+	if u.ID == 0 || v.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var request FollowRequestModel
+	db.Where(FollowRequestModel{RequesterID: u.ID, TargetID: v.ID}).First(&request)
+	return request.ID != 0
+}
+
+// 	err = userModel1.cancelFollowRequest(userModel2)
+func (u UserModel) cancelFollowRequest(v UserModel) error {
+	db := common.GetDB()
+	return db.Where(FollowRequestModel{RequesterID: u.ID, TargetID: v.ID}).Delete(FollowRequestModel{}).Error
+}
+
+// You could get a page of the users waiting for the approval of userModel, with the total count.
+// 	requesters, count, err := userModel.GetFollowRequests(20, 0)
+func (u UserModel) GetFollowRequests(limit, offset int) ([]UserModel, int, error) {
+	db := common.GetDB()
+	var models []UserModel
+	var count int
+	query := db.Model(&UserModel{}).Joins("JOIN follow_request_models ON follow_request_models.requester_id = user_models.id").
+		Where("follow_request_models.target_id = ? AND follow_request_models.deleted_at IS NULL", u.ID)
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, err
+	}
+	err := query.Order("follow_request_models.id").Offset(offset).Limit(limit).Find(&models).Error
+	return models, count, err
+}
+
+// You could approve the request of userModel2 as userModel1, userModel2 is following userModel1 afterwards.
+// It returns gorm.ErrRecordNotFound when there is no such request.
+// 	err = userModel1.approveFollowRequest(userModel2)
+func (u UserModel) approveFollowRequest(v UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	result := tx.Where(FollowRequestModel{RequesterID: v.ID, TargetID: u.ID}).Delete(FollowRequestModel{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		tx.Rollback()
+		if result.Error != nil {
+			return result.Error
+		}
+		return gorm.ErrRecordNotFound
+	}
+	var follow FollowModel
+	if err := tx.FirstOrCreate(&follow, &FollowModel{FollowingID: u.ID, FollowedByID: v.ID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// It returns gorm.ErrRecordNotFound when there is no such request.
+// 	err = userModel1.rejectFollowRequest(userModel2)
+func (u UserModel) rejectFollowRequest(v UserModel) error {
+	db := common.GetDB()
+	result := db.Where(FollowRequestModel{RequesterID: v.ID, TargetID: u.ID}).Delete(FollowRequestModel{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// The articles of a private user can only be seen by themselves and their approved followers.
+// 	if !myUserModel.CanViewContentOf(authorUserModel) { ... }
+func (u UserModel) CanViewContentOf(v UserModel) bool {
+	return !v.Private || u.ID == v.ID || u.isFollowing(v)
+}
+
+// A subquery of the IDs of the private users whose articles can't be seen by userModel,
+// checked with a NOT EXISTS on the follows so that no list of IDs is ever loaded.
+// 	query.Where("user_model_id NOT IN (?)", users.PrivateUsersHiddenFrom(myUserModel))
+func PrivateUsersHiddenFrom(u UserModel) *gorm.SqlExpr {
+	db := common.GetDB()
+	follows := db.Model(&FollowModel{}).Select("1").
+		Where("follow_models.following_id = user_models.id AND follow_models.followed_by_id = ?", u.ID)
+	return db.Model(&UserModel{}).Select("user_models.id").Where("user_models.private = ? AND user_models.id <> ?", true, u.ID).
+		Where("NOT EXISTS (?)", follows.QueryExpr()).QueryExpr()
+}
+
+// Once a user turns public nobody needs an approval anymore, the pending requests become followings.
+func (u UserModel) approveAllFollowRequests(tx *gorm.DB) error {
+	var requesterIDs []uint
+	if err := tx.Model(&FollowRequestModel{}).Where("target_id = ?", u.ID).Pluck("requester_id", &requesterIDs).Error; err != nil {
+		return err
+	}
+	for _, requesterID := range requesterIDs {
+		var follow FollowModel
+		if err := tx.FirstOrCreate(&follow, &FollowModel{FollowingID: u.ID, FollowedByID: requesterID}).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Where("target_id = ?", u.ID).Delete(FollowRequestModel{}).Error
+}
+
+// The patterns of LIKE are escaped with '!' rather than a backslash, which each database quotes its own way.
+// 	query.Where("username LIKE ? ESCAPE '!'", "%"+likeEscaper.Replace(q)+"%")
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// You could search users by a prefix or a substring of their username or bio, with the total count.
+// The best matches come first: exact username, username prefix, username substring, then bio substring.
+// An empty query lists every user by username.
+// 	userModels, count, err := SearchUsers("wang", users.BlockedUserIDs(myUserModel), 20, 0)
+func SearchUsers(q string, excluded []uint, limit, offset int) ([]UserModel, int, error) {
+	db := common.GetDB()
+	var models []UserModel
+	var count int
+	q = strings.ToLower(strings.TrimSpace(q))
+	query := db.Model(&UserModel{})
+	if len(excluded) > 0 {
+		query = query.Where("id NOT IN (?)", excluded)
+	}
+	if q != "" {
+		prefix := likeEscaper.Replace(q) + "%"
+		substring := "%" + likeEscaper.Replace(q) + "%"
+		query = query.Where("LOWER(username) LIKE ? ESCAPE '!' OR LOWER(bio) LIKE ? ESCAPE '!'", substring, substring).
+			Order(gorm.Expr("CASE WHEN LOWER(username) = ? THEN 0 WHEN LOWER(username) LIKE ? ESCAPE '!' THEN 1 "+
+				"WHEN LOWER(username) LIKE ? ESCAPE '!' THEN 2 ELSE 3 END", q, prefix, substring))
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, err
+	}
+	err := query.Order("username").Offset(offset).Limit(limit).Find(&models).Error
+	return models, count, err
+}
@@ -0,0 +1,235 @@
+package users
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// The rules a new password has to follow, the zero value of a rule disables it.
+//
+// MinClasses counts the character classes found in a password: lower case, upper case, digits and symbols.
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	RequireLower   bool
+	RequireUpper   bool
+	RequireDigit   bool
+	RequireSymbol  bool
+	MinClasses     int
+	RejectIdentity bool
+	Breached       *BreachedPasswords
+}
+
+// The policy applied on registration and whenever a password is changed.
+// Load a breached password corpus into it with LoadBreachedPasswords.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      255,
+	RejectIdentity: true,
+}
+
+// You could read the policy from the environment, the rules left unset keep their value in base:
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH and PASSWORD_MIN_CLASSES are numbers, PASSWORD_REQUIRE lists the
+// classes every password needs among lower, upper, digit and symbol (e.g. "lower,digit"), PASSWORD_REJECT_IDENTITY
+// is true or false and BREACHED_PASSWORDS_FILE is a corpus for LoadBreachedPasswords.
+// 	users.DefaultPasswordPolicy, err = users.LoadPasswordPolicy(users.DefaultPasswordPolicy, os.Getenv)
+func LoadPasswordPolicy(base PasswordPolicy, getenv func(key string) string) (PasswordPolicy, error) {
+	p := base
+	for _, setting := range []struct {
+		key   string
+		value *int
+	}{
+		{"PASSWORD_MIN_LENGTH", &p.MinLength},
+		{"PASSWORD_MAX_LENGTH", &p.MaxLength},
+		{"PASSWORD_MIN_CLASSES", &p.MinClasses},
+	} {
+		if value := getenv(setting.key); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return base, fmt.Errorf("%s should be a number, 0 disabling the rule, got %q", setting.key, value)
+			}
+			*setting.value = n
+		}
+	}
+	if p.MaxLength > 0 && p.MaxLength < p.MinLength {
+		return base, fmt.Errorf("PASSWORD_MAX_LENGTH %v is shorter than PASSWORD_MIN_LENGTH %v", p.MaxLength, p.MinLength)
+	}
+	if p.MinClasses > 4 {
+		return base, fmt.Errorf("PASSWORD_MIN_CLASSES should be at most 4, got %v", p.MinClasses)
+	}
+	if value := getenv("PASSWORD_REQUIRE"); value != "" {
+		p.RequireLower, p.RequireUpper, p.RequireDigit, p.RequireSymbol = false, false, false, false
+		for _, class := range strings.Split(value, ",") {
+			switch strings.TrimSpace(class) {
+			case "lower":
+				p.RequireLower = true
+			case "upper":
+				p.RequireUpper = true
+			case "digit":
+				p.RequireDigit = true
+			case "symbol":
+				p.RequireSymbol = true
+			case "", "none":
+			default:
+				return base, fmt.Errorf("PASSWORD_REQUIRE has an unknown class %q", class)
+			}
+		}
+	}
+	if value := getenv("PASSWORD_REJECT_IDENTITY"); value != "" {
+		reject, err := strconv.ParseBool(value)
+		if err != nil {
+			return base, fmt.Errorf("PASSWORD_REJECT_IDENTITY should be true or false, got %q", value)
+		}
+		p.RejectIdentity = reject
+	}
+	if path := getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breached, err := LoadBreachedPasswords(path)
+		if err != nil {
+			return base, err
+		}
+		p.Breached = breached
+	}
+	return p, nil
+}
+
+// Validate returns a common.FieldError on the "Password" field describing the first broken rule.
+// 	err := DefaultPasswordPolicy.Validate("password0", "username0", "user0@g.cn")
+func (p PasswordPolicy) Validate(password, username, email string) error {
+	if p.MinLength > 0 && len([]rune(password)) < p.MinLength {
+		return passwordError("{min: %v}", p.MinLength)
+	}
+	if p.MaxLength > 0 && len([]rune(password)) > p.MaxLength {
+		return passwordError("{max: %v}", p.MaxLength)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireLower && !lower {
+		return passwordError("{key: lower}")
+	}
+	if p.RequireUpper && !upper {
+		return passwordError("{key: upper}")
+	}
+	if p.RequireDigit && !digit {
+		return passwordError("{key: digit}")
+	}
+	if p.RequireSymbol && !symbol {
+		return passwordError("{key: symbol}")
+	}
+	classes := 0
+	for _, found := range []bool{lower, upper, digit, symbol} {
+		if found {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return passwordError("{classes: %v}", p.MinClasses)
+	}
+
+	if p.RejectIdentity {
+		lowered := strings.ToLower(password)
+		localPart := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+		for _, identity := range []string{strings.ToLower(username), strings.ToLower(email), localPart} {
+			if len(identity) >= 3 && strings.Contains(lowered, identity) {
+				return passwordError("{key: identity}")
+			}
+		}
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		return passwordError("{key: breached}")
+	}
+	return nil
+}
+
+func passwordError(format string, args ...interface{}) error {
+	return common.FieldError{Field: "Password", Message: fmt.Sprintf(format, args...)}
+}
+
+// A k-anonymity index of breached passwords, the SHA-1 hashes are grouped by their first 5 hex digits
+// the same way as the "Have I Been Pwned" range API does, so only a prefix ever needs to be looked up.
+type BreachedPasswords struct {
+	ranges map[string][]string
+}
+
+const breachedPrefixLength = 5
+
+// LoadBreachedPasswords reads a corpus with one entry per line.
+// An entry is either an upper or lower case SHA-1 hex digest optionally followed by ":count"
+// (the format of the downloadable "Have I Been Pwned" list) or a plain text password.
+// Empty lines and lines starting with # are ignored.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	breached := &BreachedPasswords{ranges: make(map[string][]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest := strings.ToUpper(strings.SplitN(line, ":", 2)[0])
+		if !isSHA1Hex(digest) {
+			digest = sha1Hex(line)
+		}
+		prefix := digest[:breachedPrefixLength]
+		breached.ranges[prefix] = append(breached.ranges[prefix], digest[breachedPrefixLength:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for prefix := range breached.ranges {
+		sort.Strings(breached.ranges[prefix])
+	}
+	return breached, nil
+}
+
+// Range returns the sorted hash suffixes sharing the given 5 hex digits prefix.
+func (b *BreachedPasswords) Range(prefix string) []string {
+	return b.ranges[strings.ToUpper(prefix)]
+}
+
+// Contains tells whether the password is part of the corpus.
+func (b *BreachedPasswords) Contains(password string) bool {
+	digest := sha1Hex(password)
+	suffixes := b.Range(digest[:breachedPrefixLength])
+	i := sort.SearchStrings(suffixes, digest[breachedPrefixLength:])
+	return i < len(suffixes) && suffixes[i] == digest[breachedPrefixLength:]
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
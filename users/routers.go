@@ -4,44 +4,160 @@ import (
 	"errors"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func UsersRegister(router *gin.RouterGroup) {
 	router.POST("/", UsersRegistration)
 	router.POST("/login", UsersLogin)
+	router.POST("/email/confirm", UserEmailConfirm)
 }
 
 func UserRegister(router *gin.RouterGroup) {
 	router.GET("/", UserRetrieve)
 	router.PUT("/", UserUpdate)
+	router.DELETE("/", UserDelete)
+	router.POST("/avatar", UserAvatarUpload)
+	router.POST("/export", UserExportCreate)
+	router.GET("/export/:id", UserExportRetrieve)
+	router.GET("/export/:id/download", UserExportDownload)
+	router.GET("/follow-requests", FollowRequestList)
+	router.GET("/suggestions", UserSuggestionList)
+	router.GET("/security-events", UserSecurityEventList)
+	router.POST("/tokens/revoke", UserTokensRevoke)
+	router.GET("/invitations", InvitationList)
+	router.POST("/invitations", InvitationCreate)
+	router.DELETE("/invitations/:code", InvitationDelete)
+	router.POST("/follow-requests/:username/approve", FollowRequestApprove)
+	router.POST("/follow-requests/:username/reject", FollowRequestReject)
+}
+
+// Mount it behind RequireRole(RoleAdmin).
+func AdminRegister(router *gin.RouterGroup) {
+	router.GET("/security-events", AdminSecurityEventList)
+	router.PUT("/users/:username/role", AdminUserRoleUpdate)
+	router.POST("/users/:username/impersonate", AdminUserImpersonate)
 }
 
 func ProfileRegister(router *gin.RouterGroup) {
+	router.GET("/", ProfileList)
 	router.GET("/:username", ProfileRetrieve)
 	router.POST("/:username/follow", ProfileFollow)
 	router.DELETE("/:username/follow", ProfileUnfollow)
+	router.POST("/:username/block", ProfileBlock)
+	router.DELETE("/:username/block", ProfileUnblock)
+	router.POST("/:username/mute", ProfileMute)
+	router.DELETE("/:username/mute", ProfileUnmute)
+	router.GET("/:username/followers", ProfileFollowers)
+	router.GET("/:username/following", ProfileFollowing)
+}
+
+func ProfileList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	limit, offset := paginationQuery(c)
+	userModels, count, err := SearchUsers(c.Query("q"), BlockedUserIDs(myUserModel), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfilesSerializer{c, userModels}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response(), "profilesCount": count})
 }
 
 func ProfileRetrieve(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, redirect, err := FindOneUserByUsername(username)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
 	}
 	profileSerializer := ProfileSerializer{c, userModel}
+	if redirect != nil {
+		c.JSON(http.StatusOK, gin.H{"profile": profileSerializer.Response(), "redirect": redirect})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"profile": profileSerializer.Response()})
 }
 
+// The largest page a client can ask for, larger limits are clamped to it.
+const maxPageSize = 100
+
+// Read the limit and offset query parameters the same way as the article list does.
+func paginationQuery(c *gin.Context) (int, int) {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	offset, err := strconv.Atoi(c.Query("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func ProfileFollowers(c *gin.Context) {
+	username := c.Param("username")
+	userModel, _, err := FindOneUserByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	limit, offset := paginationQuery(c)
+	followers, count, err := userModel.GetFollowers(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfilesSerializer{c, followers}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response(), "profilesCount": count})
+}
+
+func ProfileFollowing(c *gin.Context) {
+	username := c.Param("username")
+	userModel, _, err := FindOneUserByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	limit, offset := paginationQuery(c)
+	followings, count, err := userModel.GetFollowingsPage(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfilesSerializer{c, followings}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response(), "profilesCount": count})
+}
+
 func ProfileFollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, _, err := FindOneUserByUsername(username)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if IsBlockedBetween(myUserModel, userModel) {
+		c.JSON(http.StatusForbidden, common.NewError("profile", errors.New("You can't follow this user")))
+		return
+	}
+	if userModel.Private && !myUserModel.CanViewContentOf(userModel) {
+		if err := myUserModel.requestFollowing(userModel); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		serializer := ProfileSerializer{c, userModel}
+		c.JSON(http.StatusAccepted, gin.H{"profile": serializer.Response()})
+		return
+	}
 	err = myUserModel.following(userModel)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
@@ -53,7 +169,7 @@ func ProfileFollow(c *gin.Context) {
 
 func ProfileUnfollow(c *gin.Context) {
 	username := c.Param("username")
-	userModel, err := FindOneUser(&UserModel{Username: username})
+	userModel, _, err := FindOneUserByUsername(username)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
 		return
@@ -69,14 +185,84 @@ func ProfileUnfollow(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
 
+// Block, unblock, mute and unmute share the same flow, only the relationship changes.
+func changeProfileRelationship(c *gin.Context, change func(me, other UserModel) error) {
+	username := c.Param("username")
+	userModel, _, err := FindOneUserByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if myUserModel.ID == userModel.ID {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("profile", errors.New("You can't do this to yourself")))
+		return
+	}
+	if err := change(myUserModel, userModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
+}
+
+func ProfileBlock(c *gin.Context) {
+	changeProfileRelationship(c, UserModel.block)
+}
+
+func ProfileUnblock(c *gin.Context) {
+	changeProfileRelationship(c, UserModel.unBlock)
+}
+
+func ProfileMute(c *gin.Context) {
+	changeProfileRelationship(c, UserModel.mute)
+}
+
+func ProfileUnmute(c *gin.Context) {
+	changeProfileRelationship(c, UserModel.unMute)
+}
+
 func UsersRegistration(c *gin.Context) {
+	if RegistrationMode == RegistrationClosed {
+		c.JSON(http.StatusForbidden, common.NewError("registration", ErrRegistrationClosed))
+		return
+	}
 	userModelValidator := NewUserModelValidator()
 	if err := userModelValidator.Bind(c); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
 
-	if err := SaveOne(&userModelValidator.userModel); err != nil {
+	if isUsernameReserved(userModelValidator.userModel.Username, UserModel{}) {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: "Username", Message: "{key: reserved}"}))
+		return
+	}
+	if err := validateUsername(userModelValidator.userModel.Username, UserModel{}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if isUsernameTaken(userModelValidator.userModel.Username, UserModel{}) {
+		c.JSON(http.StatusConflict, common.NewError("username", ErrUsernameTaken))
+		return
+	}
+	if isEmailTaken(userModelValidator.userModel.Email, UserModel{}) {
+		c.JSON(http.StatusConflict, common.NewError("email", ErrEmailTaken))
+		return
+	}
+	err := registerUser(&userModelValidator.userModel, strings.TrimSpace(userModelValidator.User.InvitationCode), time.Now())
+	if err == ErrRegistrationClosed {
+		c.JSON(http.StatusForbidden, common.NewError("registration", err))
+		return
+	} else if _, ok := err.(common.FieldError); ok {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	} else if common.IsUniqueViolation(err) && strings.Contains(err.Error(), "username") {
+		c.JSON(http.StatusConflict, common.NewError("username", ErrUsernameTaken))
+		return
+	} else if common.IsUniqueViolation(err) {
+		c.JSON(http.StatusConflict, common.NewError("email", ErrEmailTaken))
+		return
+	} else if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
@@ -91,25 +277,58 @@ func UsersLogin(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
 		return
 	}
-	userModel, err := FindOneUser(&UserModel{Email: loginValidator.userModel.Email})
+	throttleEmail := canonicalEmail(loginValidator.userModel.Email)
+	wait, err := LoginThrottler.Check(throttleEmail, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("database", err))
+		return
+	}
+	if wait > 0 {
+		lockedUserModel, _ := FindOneUserByEmail(loginValidator.userModel.Email)
+		RecordSecurityEvent(c, EventLoginFailed, lockedUserModel, map[string]interface{}{"email": maskEmail(throttleEmail), "reason": "throttled"})
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, common.NewError("login", errors.New("Too many failed attempts, try again later")))
+		return
+	}
+	userModel, err := FindOneUserByEmail(loginValidator.userModel.Email)
 
 	if err != nil {
+		if err := LoginThrottler.Fail(throttleEmail, c.ClientIP()); err != nil {
+			log.Printf("login throttle: recording a failure failed: %v", err)
+		}
+		RecordSecurityEvent(c, EventLoginFailed, UserModel{}, map[string]interface{}{"email": maskEmail(throttleEmail), "reason": "unknown_email"})
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
 
 	if userModel.checkPassword(loginValidator.User.Password) != nil {
+		if err := LoginThrottler.Fail(throttleEmail, c.ClientIP()); err != nil {
+			log.Printf("login throttle: recording a failure failed: %v", err)
+		}
+		RecordSecurityEvent(c, EventLoginFailed, userModel, map[string]interface{}{"email": maskEmail(throttleEmail), "reason": "invalid_password"})
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
+	if err := LoginThrottler.Succeed(throttleEmail); err != nil {
+		log.Printf("login throttle: clearing the failures failed: %v", err)
+	}
+	if err := userModel.rehashPassword(loginValidator.User.Password); err != nil {
+		log.Printf("rehash password of user %d: %v", userModel.ID, err)
+	}
 	UpdateContextUserModel(c, userModel.ID)
+	RecordSecurityEvent(c, EventLoginSucceeded, userModel, nil)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
 
 func UserRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
 	serializer := UserSerializer{c}
-	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
+	response := gin.H{"user": serializer.Response()}
+	if pendingEmail := myUserModel.pendingEmail(time.Now()); pendingEmail != "" {
+		response["pendingEmail"] = pendingEmail
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func UserUpdate(c *gin.Context) {
@@ -121,11 +340,420 @@ func UserUpdate(c *gin.Context) {
 	}
 
 	userModelValidator.userModel.ID = myUserModel.ID
-	if err := myUserModel.Update(userModelValidator.userModel); err != nil {
+	// A new email is only used once confirmed, and asking for it needs the password in case the session was stolen.
+	newEmail := userModelValidator.userModel.Email
+	userModelValidator.userModel.Email = myUserModel.Email
+	if newEmail != myUserModel.Email || userModelValidator.User.Password != common.NBRandomPassword {
+		if forbidImpersonation(c) {
+			return
+		}
+	}
+	if newEmail != myUserModel.Email {
+		if userModelValidator.User.CurrentPassword == "" {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: "CurrentPassword", Message: "{key: required}"}))
+			return
+		}
+		if myUserModel.checkPassword(userModelValidator.User.CurrentPassword) != nil {
+			c.JSON(http.StatusForbidden, common.NewError("user", errors.New("Invalid password")))
+			return
+		}
+		if isEmailTaken(newEmail, myUserModel) {
+			c.JSON(http.StatusConflict, common.NewError("email", ErrEmailTaken))
+			return
+		}
+	}
+	var previousImage string
+	if myUserModel.Image != nil {
+		previousImage = *myUserModel.Image
+	}
+	wasPrivate := myUserModel.Private
+	// The rename and the profile are saved together, a failure leaves the user as it was.
+	tx := common.GetDB().Begin()
+	if err := myUserModel.changeUsername(tx, userModelValidator.userModel.Username, time.Now()); err != nil {
+		tx.Rollback()
+		if _, ok := err.(common.FieldError); ok {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		} else if err == ErrUsernameTaken {
+			c.JSON(http.StatusConflict, common.NewError("username", err))
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		}
+		return
+	}
+	err := tx.Model(&myUserModel).Update(userModelValidator.userModel).Error
+	if err == nil {
+		// Update with a struct skips the blank fields, the ones which can be cleared are updated by name.
+		err = tx.Model(&myUserModel).Update(map[string]interface{}{
+			"private":      userModelValidator.userModel.Private,
+			"website":      userModelValidator.userModel.Website,
+			"location":     userModelValidator.userModel.Location,
+			"pronouns":     userModelValidator.userModel.Pronouns,
+			"social_links": userModelValidator.userModel.SocialLinks,
+		}).Error
+	}
+	if err == nil && wasPrivate && !myUserModel.Private {
+		err = myUserModel.approveAllFollowRequests(tx)
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	// The uploaded avatar is forgotten once the image points somewhere else.
+	if image := userModelValidator.userModel.Image; image != nil && *image != previousImage {
+		if err := myUserModel.removeAvatar(); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+	}
+	if userModelValidator.User.Password != common.NBRandomPassword {
+		RecordSecurityEvent(c, EventPasswordChanged, myUserModel, nil)
+	}
+	// The verification email goes out last, once nothing else can fail.
+	if newEmail != myUserModel.Email {
+		if _, err := myUserModel.requestEmailChange(newEmail, time.Now()); err == ErrEmailTaken {
+			c.JSON(http.StatusConflict, common.NewError("email", err))
+			return
+		} else if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("email", err))
+			return
+		}
+		RecordSecurityEvent(c, EventEmailChangeRequested, myUserModel, map[string]interface{}{"newEmail": newEmail})
+	}
+	UpdateContextUserModel(c, myUserModel.ID)
+	UserRetrieve(c)
+}
+
+func UserEmailConfirm(c *gin.Context) {
+	emailConfirmValidator := NewEmailConfirmValidator()
+	if err := emailConfirmValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	userModel, err := confirmEmailChange(emailConfirmValidator.User.Token, time.Now())
+	if gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusNotFound, common.NewError("token", errors.New("Invalid or expired token")))
+		return
+	} else if err == ErrEmailTaken {
+		c.JSON(http.StatusConflict, common.NewError("email", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	RecordSecurityEvent(c, EventEmailChanged, userModel, map[string]interface{}{"email": userModel.Email})
+	c.JSON(http.StatusOK, gin.H{"user": "Email change confirmed"})
+}
+
+func UserDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if forbidImpersonation(c) {
+		return
+	}
+	accountDeletionValidator := NewAccountDeletionValidator()
+	if err := accountDeletionValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if myUserModel.checkPassword(accountDeletionValidator.User.Password) != nil {
+		c.JSON(http.StatusForbidden, common.NewError("user", errors.New("Invalid password")))
+		return
+	}
+	if err := DeleteAccount(myUserModel); err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	RecordSecurityEvent(c, EventAccountDeleted, myUserModel, map[string]interface{}{"username": myUserModel.Username})
+	c.JSON(http.StatusOK, gin.H{"user": "Delete success"})
+}
+
+func UserAvatarUpload(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	// Leave some room for the multipart headers, the file itself is checked against AvatarMaxSize.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, AvatarMaxSize+64<<10)
+	file, _, err := c.Request.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(common.FieldError{Field: "Avatar", Message: "{key: required}"}))
+		return
+	}
+	defer file.Close()
+	if err := myUserModel.setAvatar(file); err != nil {
+		if _, ok := err.(common.FieldError); ok {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("storage", err))
+		}
+		return
+	}
 	UpdateContextUserModel(c, myUserModel.ID)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
+
+func UserExportCreate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	exportModel, err := RequestExport(myUserModel)
+	if err == ErrExportPending {
+		c.JSON(http.StatusTooManyRequests, common.NewError("export", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ExportSerializer{c, exportModel}
+	c.JSON(http.StatusAccepted, gin.H{"export": serializer.Response()})
+}
+
+func findContextExport(c *gin.Context) (ExportModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("export", errors.New("Invalid id")))
+		return ExportModel{}, false
+	}
+	exportModel, err := FindOneExport(myUserModel, uint(id64))
+	if err != nil || exportModel.expired(time.Now()) {
+		c.JSON(http.StatusNotFound, common.NewError("export", errors.New("Invalid id")))
+		return exportModel, false
+	}
+	return exportModel, true
+}
+
+func UserExportRetrieve(c *gin.Context) {
+	exportModel, ok := findContextExport(c)
+	if !ok {
+		return
+	}
+	serializer := ExportSerializer{c, exportModel}
+	c.JSON(http.StatusOK, gin.H{"export": serializer.Response()})
+}
+
+func UserExportDownload(c *gin.Context) {
+	// The personal data stays with its owner, even for the admins.
+	if forbidImpersonation(c) {
+		return
+	}
+	exportModel, ok := findContextExport(c)
+	if !ok {
+		return
+	}
+	if exportModel.Status != ExportReady {
+		c.JSON(http.StatusConflict, common.NewError("export", errors.New("Export is not ready")))
+		return
+	}
+	url, err := common.MediaStorage.SignedURL(exportModel.Path, ExportLinkTTL)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("storage", err))
+		return
+	}
+	c.Redirect(http.StatusFound, url)
+}
+
+func FollowRequestList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	limit, offset := paginationQuery(c)
+	requesters, count, err := myUserModel.GetFollowRequests(limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfilesSerializer{c, requesters}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response(), "profilesCount": count})
+}
+
+func answerFollowRequest(c *gin.Context, answer func(me, requester UserModel) error) {
+	username := c.Param("username")
+	userModel, _, err := FindOneUserByUsername(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	err = answer(myUserModel, userModel)
+	if gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusNotFound, common.NewError("followRequest", errors.New("No pending request from this user")))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
+}
+
+func FollowRequestApprove(c *gin.Context) {
+	answerFollowRequest(c, UserModel.approveFollowRequest)
+}
+
+func FollowRequestReject(c *gin.Context) {
+	answerFollowRequest(c, UserModel.rejectFollowRequest)
+}
+
+func UserSuggestionList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	limit, _ := paginationQuery(c)
+	suggestions, err := SuggestUsers(myUserModel, limit)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := SuggestionsSerializer{c, suggestions}
+	c.JSON(http.StatusOK, gin.H{"suggestions": serializer.Response()})
+}
+
+func InvitationList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	invitationModels, err := myUserModel.GetInvitations()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := InvitationsSerializer{c, invitationModels}
+	c.JSON(http.StatusOK, gin.H{"invitations": serializer.Response(), "invitationsCount": len(invitationModels)})
+}
+
+func InvitationCreate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if RegistrationMode == RegistrationClosed {
+		c.JSON(http.StatusForbidden, common.NewError("registration", ErrRegistrationClosed))
+		return
+	}
+	invitationModelValidator := NewInvitationModelValidator()
+	if err := invitationModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	invitationModel, err := newInvitation(myUserModel, invitationModelValidator.Invitation.MaxUses,
+		invitationModelValidator.Invitation.ExpiresAt, time.Now())
+	if _, ok := err.(common.FieldError); ok {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	} else if err == ErrInvitationQuota {
+		c.JSON(http.StatusTooManyRequests, common.NewError("invitation", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := InvitationSerializer{c, invitationModel}
+	c.JSON(http.StatusCreated, gin.H{"invitation": serializer.Response()})
+}
+
+func InvitationDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	invitationModel, err := FindOneInvitation(myUserModel, c.Param("code"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("invitation", errors.New("Invalid code")))
+		return
+	}
+	if err := common.GetDB().Delete(&invitationModel).Error; err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"invitation": "Delete success"})
+}
+
+func UserSecurityEventList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	limit, offset := paginationQuery(c)
+	events, count, err := FindSecurityEvents(SecurityEventFilter{UserModelID: myUserModel.ID}, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := SecurityEventsSerializer{c, events}
+	c.JSON(http.StatusOK, gin.H{"securityEvents": serializer.Response(), "securityEventsCount": count})
+}
+
+func UserTokensRevoke(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if forbidImpersonation(c) {
+		return
+	}
+	if err := myUserModel.revokeTokens(time.Now()); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	RecordSecurityEvent(c, EventTokensRevoked, myUserModel, nil)
+	// The new token of the response is issued after the revocation, it keeps this session signed in.
+	UpdateContextUserModel(c, myUserModel.ID)
+	UserRetrieve(c)
+}
+
+// The admins query the whole audit log, filtered by ?user=, ?actor= and ?type=.
+func AdminSecurityEventList(c *gin.Context) {
+	var filter SecurityEventFilter
+	for _, param := range []struct {
+		name string
+		id   *uint
+	}{{"user", &filter.UserModelID}, {"actor", &filter.ActorID}} {
+		if username := c.Query(param.name); username != "" {
+			userModel, _, err := FindOneUserByUsername(username)
+			if err != nil {
+				c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+				return
+			}
+			*param.id = userModel.ID
+		}
+	}
+	filter.Type = c.Query("type")
+	limit, offset := paginationQuery(c)
+	events, count, err := FindSecurityEvents(filter, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := SecurityEventsSerializer{c, events}
+	c.JSON(http.StatusOK, gin.H{"securityEvents": serializer.Response(), "securityEventsCount": count})
+}
+
+func AdminUserRoleUpdate(c *gin.Context) {
+	userModel, _, err := FindOneUserByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	roleValidator := NewRoleValidator()
+	if err := roleValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	previousRole := userModel.Role
+	if err := userModel.setRole(roleValidator.User.Role); err != nil {
+		if _, ok := err.(common.FieldError); ok {
+			c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		} else {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		}
+		return
+	}
+	RecordSecurityEvent(c, EventRoleChanged, userModel, map[string]interface{}{"from": previousRole, "to": userModel.Role})
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response(), "role": userModel.Role})
+}
+
+// Support staff get a short-lived token to see the site as the user does, every request made with it is audited.
+func AdminUserImpersonate(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	userModel, _, err := FindOneUserByUsername(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	token, expiresAt, err := startImpersonation(myUserModel, userModel, time.Now())
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	RecordSecurityEvent(c, EventImpersonationStarted, userModel, map[string]interface{}{"expiresAt": expiresAt.UTC().Format(time.RFC3339)})
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"impersonation": gin.H{
+		"token":     token,
+		"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+		"profile":   serializer.Response(),
+	}})
+}
@@ -1,6 +1,8 @@
 package users
 
 import (
+	"encoding/json"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
@@ -13,46 +15,266 @@ type ProfileSerializer struct {
 
 // Declare your response schema here
 type ProfileResponse struct {
-	ID        uint    `json:"-"`
-	Username  string  `json:"username"`
-	Bio       string  `json:"bio"`
-	Image     *string `json:"image"`
-	Following bool    `json:"following"`
+	ID              uint     `json:"-"`
+	Username        string   `json:"username"`
+	Bio             string   `json:"bio"`
+	Image           *string  `json:"image"`
+	Website         string   `json:"website"`
+	Location        string   `json:"location"`
+	Pronouns        string   `json:"pronouns"`
+	SocialLinks     []string `json:"socialLinks"`
+	Following       bool     `json:"following"`
+	FollowersCount  int      `json:"followersCount"`
+	FollowingCount  int      `json:"followingCount"`
+	Blocking        bool     `json:"blocking"`
+	Muting          bool     `json:"muting"`
+	Private         bool     `json:"private"`
+	FollowRequested bool     `json:"followRequested"`
 }
 
 // Put your response logic including wrap the userModel here.
 func (self *ProfileSerializer) Response() ProfileResponse {
-	myUserModel := self.C.MustGet("my_user_model").(UserModel)
+	relations := self.relations()
 	profile := ProfileResponse{
-		ID:        self.ID,
-		Username:  self.Username,
-		Bio:       self.Bio,
-		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+		ID:              self.ID,
+		Username:        self.Username,
+		Bio:             self.Bio,
+		Image:           self.Image,
+		Website:         self.Website,
+		Location:        self.Location,
+		Pronouns:        self.Pronouns,
+		SocialLinks:     self.socialLinks(),
+		Following:       relations.following[self.ID],
+		FollowersCount:  relations.followers[self.ID],
+		FollowingCount:  relations.followings[self.ID],
+		Blocking:        relations.blocking[self.ID],
+		Muting:          relations.muting[self.ID],
+		Private:         self.Private,
+		FollowRequested: relations.requested[self.ID],
 	}
 	return profile
 }
 
+// The relations preloaded by PreloadProfiles, or those of this profile alone when it isn't part of a page.
+func (self *ProfileSerializer) relations() profileRelations {
+	if preloaded, ok := self.C.Get("profile_relations"); ok {
+		if relations := preloaded.(profileRelations); relations.loaded[self.ID] {
+			return relations
+		}
+	}
+	myUserModel := self.C.MustGet("my_user_model").(UserModel)
+	relations, _ := loadProfileRelations(myUserModel, []uint{self.ID})
+	return relations
+}
+
+// You could load what ProfileSerializer shows of a whole page of users at once,
+// the serializers of the page then read it from the context instead of querying for every profile.
+// 	users.PreloadProfiles(c, authors)
+func PreloadProfiles(c *gin.Context, userModels []UserModel) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	var ids []uint
+	seen := map[uint]bool{}
+	for _, userModel := range userModels {
+		if userModel.ID != 0 && !seen[userModel.ID] {
+			seen[userModel.ID] = true
+			ids = append(ids, userModel.ID)
+		}
+	}
+	relations, err := loadProfileRelations(myUserModel, ids)
+	if err != nil {
+		return
+	}
+	relations.loaded = seen
+	c.Set("profile_relations", relations)
+}
+
+type ProfilesSerializer struct {
+	C     *gin.Context
+	Users []UserModel
+}
+
+func (self *ProfilesSerializer) Response() []ProfileResponse {
+	PreloadProfiles(self.C, self.Users)
+	response := []ProfileResponse{}
+	for _, userModel := range self.Users {
+		serializer := ProfileSerializer{self.C, userModel}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type SuggestionsSerializer struct {
+	C           *gin.Context
+	Suggestions []Suggestion
+}
+
+type SuggestionResponse struct {
+	Profile ProfileResponse `json:"profile"`
+	Reason  string          `json:"reason"`
+}
+
+func (self *SuggestionsSerializer) Response() []SuggestionResponse {
+	var userModels []UserModel
+	for _, suggestion := range self.Suggestions {
+		userModels = append(userModels, suggestion.UserModel)
+	}
+	PreloadProfiles(self.C, userModels)
+	response := []SuggestionResponse{}
+	for _, suggestion := range self.Suggestions {
+		serializer := ProfileSerializer{self.C, suggestion.UserModel}
+		response = append(response, SuggestionResponse{Profile: serializer.Response(), Reason: suggestion.Reason})
+	}
+	return response
+}
+
 type UserSerializer struct {
 	c *gin.Context
 }
 
 type UserResponse struct {
-	Username string  `json:"username"`
-	Email    string  `json:"email"`
-	Bio      string  `json:"bio"`
-	Image    *string `json:"image"`
-	Token    string  `json:"token"`
+	Username    string   `json:"username"`
+	Email       string   `json:"email"`
+	Bio         string   `json:"bio"`
+	Image       *string  `json:"image"`
+	Website     string   `json:"website"`
+	Location    string   `json:"location"`
+	Pronouns    string   `json:"pronouns"`
+	SocialLinks []string `json:"socialLinks"`
+	Private     bool     `json:"private"`
+	Token       string   `json:"token"`
 }
 
 func (self *UserSerializer) Response() UserResponse {
 	myUserModel := self.c.MustGet("my_user_model").(UserModel)
 	user := UserResponse{
-		Username: myUserModel.Username,
-		Email:    myUserModel.Email,
-		Bio:      myUserModel.Bio,
-		Image:    myUserModel.Image,
-		Token:    common.GenToken(myUserModel.ID),
+		Username:    myUserModel.Username,
+		Email:       myUserModel.Email,
+		Bio:         myUserModel.Bio,
+		Image:       myUserModel.Image,
+		Website:     myUserModel.Website,
+		Location:    myUserModel.Location,
+		Pronouns:    myUserModel.Pronouns,
+		SocialLinks: myUserModel.socialLinks(),
+		Private:     myUserModel.Private,
+		Token:       common.GenToken(myUserModel.ID),
+	}
+	// An impersonation must not turn into a regular session of the user.
+	if _, ok := Impersonator(self.c); ok {
+		user.Token = self.c.GetString("impersonation_token")
 	}
 	return user
 }
+
+type ExportSerializer struct {
+	C *gin.Context
+	ExportModel
+}
+
+type ExportResponse struct {
+	ID        uint   `json:"id"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func (self *ExportSerializer) Response() ExportResponse {
+	return ExportResponse{
+		ID:        self.ID,
+		Status:    self.Status,
+		CreatedAt: self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		ExpiresAt: self.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+type InvitationSerializer struct {
+	C *gin.Context
+	InvitationModel
+}
+
+type InvitationResponse struct {
+	Code      string   `json:"code"`
+	MaxUses   int      `json:"maxUses"`
+	Uses      int      `json:"uses"`
+	CreatedAt string   `json:"createdAt"`
+	ExpiresAt *string  `json:"expiresAt"`
+	Invitees  []string `json:"invitees"`
+}
+
+func (self *InvitationSerializer) Response() InvitationResponse {
+	response := InvitationResponse{
+		Code:      self.Code,
+		MaxUses:   self.MaxUses,
+		Uses:      self.Uses,
+		CreatedAt: self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Invitees:  self.invitees(),
+	}
+	if self.ExpiresAt != nil {
+		expiresAt := self.ExpiresAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.ExpiresAt = &expiresAt
+	}
+	return response
+}
+
+type InvitationsSerializer struct {
+	C           *gin.Context
+	Invitations []InvitationModel
+}
+
+func (self *InvitationsSerializer) Response() []InvitationResponse {
+	response := []InvitationResponse{}
+	for _, invitationModel := range self.Invitations {
+		serializer := InvitationSerializer{self.C, invitationModel}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type SecurityEventsSerializer struct {
+	C      *gin.Context
+	Events []SecurityEventModel
+}
+
+type SecurityEventResponse struct {
+	ID        uint        `json:"id"`
+	Type      string      `json:"type"`
+	User      *string     `json:"user"`
+	Actor     *string     `json:"actor"`
+	IP        string      `json:"ip"`
+	UserAgent string      `json:"userAgent"`
+	RequestID string      `json:"requestId"`
+	Details   interface{} `json:"details"`
+	CreatedAt string      `json:"createdAt"`
+}
+
+// The users are given by their current username, nil when there is none or the account was deleted.
+func (self *SecurityEventsSerializer) Response() []SecurityEventResponse {
+	usernames := map[uint]*string{}
+	username := func(id uint) *string {
+		if cached, ok := usernames[id]; ok || id == 0 {
+			return cached
+		}
+		if userModel, err := FindOneUser(&UserModel{ID: id}); err == nil {
+			usernames[id] = &userModel.Username
+		} else {
+			usernames[id] = nil
+		}
+		return usernames[id]
+	}
+	response := []SecurityEventResponse{}
+	for _, event := range self.Events {
+		var details interface{}
+		json.Unmarshal([]byte(event.Details), &details)
+		response = append(response, SecurityEventResponse{
+			ID:        event.ID,
+			Type:      event.Type,
+			User:      username(event.UserModelID),
+			Actor:     username(event.ActorID),
+			IP:        event.IP,
+			UserAgent: event.UserAgent,
+			RequestID: event.RequestID,
+			Details:   details,
+			CreatedAt: event.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+	return response
+}
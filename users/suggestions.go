@@ -0,0 +1,153 @@
+package users
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// A Suggestion recommends following the user UserID, Score weighs it against the other suggestions
+// and Reason explains it to the caller. UserModel is only loaded by SuggestUsers.
+type Suggestion struct {
+	UserID    uint
+	Score     int
+	Reason    string
+	UserModel UserModel
+}
+
+// A SuggestionSource recommends at most limit users for userModel to follow, the best scored ones.
+// The same user may be suggested by several sources.
+type SuggestionSource func(userModel UserModel, limit int) ([]Suggestion, error)
+
+var suggestionSources = []SuggestionSource{friendsOfFriends}
+
+// Modules depending on users add their own suggestions here, e.g. the authors of the favorited articles.
+// 	users.RegisterSuggestionSource(articles.SuggestFavoritedAuthors)
+func RegisterSuggestionSource(source SuggestionSource) {
+	suggestionSources = append(suggestionSources, source)
+}
+
+// The users followed by the users userModel follows, weighted by how many of them follow each one.
+// The reason names the first of them by username.
+func friendsOfFriends(u UserModel, limit int) ([]Suggestion, error) {
+	db := common.GetDB()
+	followed := db.Model(&FollowModel{}).Select("following_id").Where("followed_by_id = ?", u.ID).QueryExpr()
+	rows, err := db.Table("follow_models AS mine").
+		Select("theirs.following_id, COUNT(*), MIN(user_models.username)").
+		Joins("JOIN follow_models AS theirs ON theirs.followed_by_id = mine.following_id AND theirs.deleted_at IS NULL").
+		Joins("JOIN user_models ON user_models.id = mine.following_id").
+		Where("mine.followed_by_id = ? AND mine.deleted_at IS NULL", u.ID).
+		Where("theirs.following_id <> ? AND theirs.following_id NOT IN (?)", u.ID, followed).
+		Group("theirs.following_id").Order("COUNT(*) DESC, theirs.following_id").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []Suggestion
+	for rows.Next() {
+		var id uint
+		var count int
+		var username string
+		if err := rows.Scan(&id, &count, &username); err != nil {
+			return nil, err
+		}
+		reason := fmt.Sprintf("Followed by %s", username)
+		if count == 2 {
+			reason += " and 1 other you follow"
+		} else if count > 2 {
+			reason += fmt.Sprintf(" and %d others you follow", count-1)
+		}
+		suggestions = append(suggestions, Suggestion{UserID: id, Score: 3 * count, Reason: reason})
+	}
+	return suggestions, rows.Err()
+}
+
+// The IDs of the users never suggested to userModel: itself, the ones it follows or asked to follow,
+// and the blocked and muted ones.
+func suggestionExcludedIDs(u UserModel) map[uint]bool {
+	db := common.GetDB()
+	excluded := map[uint]bool{0: true, u.ID: true}
+	var followings, requested []uint
+	db.Model(&FollowModel{}).Where(FollowModel{FollowedByID: u.ID}).Pluck("following_id", &followings)
+	db.Model(&FollowRequestModel{}).Where(FollowRequestModel{RequesterID: u.ID}).Pluck("target_id", &requested)
+	for _, ids := range [][]uint{followings, requested, HiddenUserIDs(u)} {
+		for _, id := range ids {
+			excluded[id] = true
+		}
+	}
+	return excluded
+}
+
+// How many suggestions each source is asked for, as a multiple of the limit: the excluded users take some of them.
+const suggestionSourceFactor = 5
+
+// You could get the best limit suggestions of every source for userModel,
+// the scores of a user are summed and the reason of its best scored suggestion is kept.
+// 	suggestions, err := SuggestUsers(myUserModel, 20)
+func SuggestUsers(u UserModel, limit int) ([]Suggestion, error) {
+	var suggestions []Suggestion
+	if u.ID == 0 || limit <= 0 {
+		return suggestions, nil
+	}
+	excluded := suggestionExcludedIDs(u)
+	merged := make(map[uint]*Suggestion)
+	best := make(map[uint]int)
+	for _, source := range suggestionSources {
+		sourceSuggestions, err := source(u, limit*suggestionSourceFactor)
+		if err != nil {
+			return nil, err
+		}
+		for _, suggestion := range sourceSuggestions {
+			if excluded[suggestion.UserID] {
+				continue
+			}
+			if merged[suggestion.UserID] == nil {
+				merged[suggestion.UserID] = &Suggestion{UserID: suggestion.UserID}
+			}
+			merged[suggestion.UserID].Score += suggestion.Score
+			if suggestion.Score > best[suggestion.UserID] {
+				best[suggestion.UserID] = suggestion.Score
+				merged[suggestion.UserID].Reason = suggestion.Reason
+			}
+		}
+	}
+	if len(merged) == 0 {
+		return suggestions, nil
+	}
+
+	// Only the best limit users are loaded.
+	ranked := make([]*Suggestion, 0, len(merged))
+	for _, suggestion := range merged {
+		ranked = append(ranked, suggestion)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].UserID < ranked[j].UserID
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	ids := make([]uint, 0, len(ranked))
+	for _, suggestion := range ranked {
+		ids = append(ids, suggestion.UserID)
+	}
+	var userModels []UserModel
+	if err := common.GetDB().Where("id IN (?)", ids).Find(&userModels).Error; err != nil {
+		return nil, err
+	}
+	loaded := make(map[uint]UserModel)
+	for _, userModel := range userModels {
+		loaded[userModel.ID] = userModel
+	}
+	for _, suggestion := range ranked {
+		if userModel, ok := loaded[suggestion.UserID]; ok {
+			suggestion.UserModel = userModel
+			suggestions = append(suggestions, *suggestion)
+		}
+	}
+	return suggestions, nil
+}
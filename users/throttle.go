@@ -0,0 +1,285 @@
+package users
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// Failed login attempts are counted per key, a key looks like "email:user1@linkedin.com" or "ip:127.0.0.1".
+//
+// Failures older than the window of the policy are forgotten, LockedUntil is set once the
+// number of failures reaches the limit of the policy.
+type LoginAttemptModel struct {
+	ID             uint       `gorm:"primary_key"`
+	Key            string     `gorm:"column:key;unique_index"`
+	Failures       int        `gorm:"column:failures"`
+	FirstFailureAt time.Time  `gorm:"column:first_failure_at"`
+	LastFailureAt  time.Time  `gorm:"column:last_failure_at"`
+	LockedUntil    *time.Time `gorm:"column:locked_until"`
+	// Bumped by every update of DBLoginAttemptStore, which only writes the counter when it didn't change since it was read.
+	Version int `gorm:"column:version"`
+}
+
+// A LoginAttemptStore keeps the failure counters.
+// Use the memory store for a single instance and the database store when running several instances.
+type LoginAttemptStore interface {
+	// Get returns the counter of key, a zero LoginAttemptModel if there is none.
+	Get(key string) (LoginAttemptModel, error)
+	// Update loads the counter of key, applies fn to it and saves it atomically: concurrent updates all count.
+	Update(key string, fn func(attempt *LoginAttemptModel)) (LoginAttemptModel, error)
+	// Delete forgets the counter of key.
+	Delete(key string) error
+}
+
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttemptModel
+}
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]LoginAttemptModel)}
+}
+
+func (s *MemoryLoginAttemptStore) Get(key string) (LoginAttemptModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+func (s *MemoryLoginAttemptStore) Update(key string, fn func(attempt *LoginAttemptModel)) (LoginAttemptModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt := s.attempts[key]
+	attempt.Key = key
+	fn(&attempt)
+	s.attempts[key] = attempt
+	return attempt, nil
+}
+
+func (s *MemoryLoginAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// The database store shares the counters between every instance using the same database.
+// Remember to migrate LoginAttemptModel, AutoMigrate does it for you.
+type DBLoginAttemptStore struct{}
+
+func NewDBLoginAttemptStore() *DBLoginAttemptStore {
+	return &DBLoginAttemptStore{}
+}
+
+func (s *DBLoginAttemptStore) Get(key string) (LoginAttemptModel, error) {
+	db := common.GetDB()
+	var attempt LoginAttemptModel
+	err := db.Where(LoginAttemptModel{Key: key}).First(&attempt).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return attempt, nil
+	}
+	return attempt, err
+}
+
+// How many times Update reads the counter again when another instance changed it in the meantime.
+const loginAttemptUpdateRetries = 10
+
+var ErrLoginAttemptConflict = errors.New("login attempt counter changed concurrently too many times")
+
+// The counter is written only if its Version is still the one read, or created if it didn't exist and
+// nobody created it meanwhile. Otherwise fn is applied again to the fresh counter, so no failure is lost.
+func (s *DBLoginAttemptStore) Update(key string, fn func(attempt *LoginAttemptModel)) (LoginAttemptModel, error) {
+	db := common.GetDB()
+	for retry := 0; retry < loginAttemptUpdateRetries; retry++ {
+		var attempt LoginAttemptModel
+		err := db.Where(LoginAttemptModel{Key: key}).First(&attempt).Error
+		if gorm.IsRecordNotFoundError(err) {
+			attempt = LoginAttemptModel{Key: key}
+			fn(&attempt)
+			attempt.Version = 1
+			if err := db.Create(&attempt).Error; !common.IsUniqueViolation(err) {
+				return attempt, err
+			}
+			continue
+		} else if err != nil {
+			return attempt, err
+		}
+		version := attempt.Version
+		fn(&attempt)
+		attempt.Key = key
+		attempt.Version = version + 1
+		result := db.Model(&LoginAttemptModel{}).Where("id = ? AND version = ?", attempt.ID, version).
+			Updates(map[string]interface{}{
+				"failures":         attempt.Failures,
+				"first_failure_at": attempt.FirstFailureAt,
+				"last_failure_at":  attempt.LastFailureAt,
+				"locked_until":     attempt.LockedUntil,
+				"version":          attempt.Version,
+			})
+		if result.Error != nil || result.RowsAffected == 1 {
+			return attempt, result.Error
+		}
+	}
+	return LoginAttemptModel{}, ErrLoginAttemptConflict
+}
+
+func (s *DBLoginAttemptStore) Delete(key string) error {
+	db := common.GetDB()
+	return db.Where(LoginAttemptModel{Key: key}).Delete(LoginAttemptModel{}).Error
+}
+
+// How many failures are tolerated and how long a client has to wait.
+//
+// After the n-th failure the next attempt is delayed by BaseDelay * 2^(n-1), capped at MaxDelay.
+// Once MaxFailures is reached within Window, the key is locked for Lockout.
+type ThrottlePolicy struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if failures <= 0 || p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// LoginThrottle tracks failed logins per email and per client IP.
+// 	if wait, _ := LoginThrottler.Check(email, ip); wait > 0 { ... }
+type LoginThrottle struct {
+	Store LoginAttemptStore
+	Email ThrottlePolicy
+	IP    ThrottlePolicy
+	Now   func() time.Time
+}
+
+// A single IP is shared by many users behind a NAT, so it gets a more generous policy than an email.
+func NewLoginThrottle(store LoginAttemptStore) *LoginThrottle {
+	return &LoginThrottle{
+		Store: store,
+		Email: ThrottlePolicy{
+			MaxFailures: 5,
+			Window:      15 * time.Minute,
+			Lockout:     15 * time.Minute,
+			BaseDelay:   time.Second,
+			MaxDelay:    30 * time.Second,
+		},
+		IP: ThrottlePolicy{
+			MaxFailures: 50,
+			Window:      15 * time.Minute,
+			Lockout:     15 * time.Minute,
+		},
+		Now: time.Now,
+	}
+}
+
+// The throttle used by UsersLogin, swap the Store with NewDBLoginAttemptStore() when running several instances.
+var LoginThrottler = NewLoginThrottle(NewMemoryLoginAttemptStore())
+
+func emailThrottleKey(email string) string {
+	return "email:" + email
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the client should wait before trying to login again, zero means go ahead.
+func (t *LoginThrottle) Check(email, ip string) (time.Duration, error) {
+	wait, err := t.check(emailThrottleKey(email), t.Email)
+	if err != nil {
+		return 0, err
+	}
+	ipWait, err := t.check(ipThrottleKey(ip), t.IP)
+	if err != nil {
+		return 0, err
+	}
+	if ipWait > wait {
+		wait = ipWait
+	}
+	return wait, nil
+}
+
+func (t *LoginThrottle) check(key string, policy ThrottlePolicy) (time.Duration, error) {
+	attempt, err := t.Store.Get(key)
+	if err != nil || attempt.Failures == 0 {
+		return 0, err
+	}
+	now := t.Now()
+	if attempt.LockedUntil != nil {
+		if now.Before(*attempt.LockedUntil) {
+			return attempt.LockedUntil.Sub(now), nil
+		}
+		log.Printf("audit: login lockout of %s expired after %d failures", key, attempt.Failures)
+		return 0, t.Store.Delete(key)
+	}
+	if now.Sub(attempt.FirstFailureAt) > policy.Window {
+		return 0, t.Store.Delete(key)
+	}
+	if next := attempt.LastFailureAt.Add(policy.delay(attempt.Failures)); now.Before(next) {
+		return next.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Fail records a failed attempt for both the email and the IP.
+func (t *LoginThrottle) Fail(email, ip string) error {
+	if err := t.fail(emailThrottleKey(email), t.Email); err != nil {
+		return err
+	}
+	return t.fail(ipThrottleKey(ip), t.IP)
+}
+
+func (t *LoginThrottle) fail(key string, policy ThrottlePolicy) error {
+	now := t.Now()
+	attempt, err := t.Store.Update(key, func(attempt *LoginAttemptModel) {
+		if attempt.Failures == 0 || now.Sub(attempt.FirstFailureAt) > policy.Window {
+			attempt.Failures = 0
+			attempt.FirstFailureAt = now
+			attempt.LockedUntil = nil
+		}
+		attempt.Failures++
+		attempt.LastFailureAt = now
+		if policy.MaxFailures > 0 && attempt.Failures >= policy.MaxFailures {
+			lockedUntil := now.Add(policy.Lockout)
+			attempt.LockedUntil = &lockedUntil
+		}
+	})
+	if err == nil && attempt.LockedUntil != nil && attempt.Failures == policy.MaxFailures {
+		log.Printf("audit: login locked for %s until %s", key, attempt.LockedUntil.UTC().Format(time.RFC3339))
+	}
+	return err
+}
+
+// Succeed forgets the failures of the email. The IP counter is kept on purpose,
+// otherwise an attacker could reset it by logging into an account of their own.
+func (t *LoginThrottle) Succeed(email string) error {
+	key := emailThrottleKey(email)
+	attempt, err := t.Store.Get(key)
+	if err != nil || attempt.Failures == 0 {
+		return err
+	}
+	log.Printf("audit: login failures of %s cleared by a successful login", key)
+	return t.Store.Delete(key)
+}
+
+// Unlock lifts the lockout of an email by hand, e.g. after the owner proved who they are to the support.
+func (t *LoginThrottle) Unlock(email string) error {
+	log.Printf("audit: login lockout of %s lifted manually", emailThrottleKey(email))
+	return t.Store.Delete(emailThrottleKey(email))
+}
@@ -1,18 +1,30 @@
 package users
 
 import (
+	"archive/zip"
 	"github.com/stretchr/testify/assert"
 	"testing"
 
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/jinzhu/gorm"
+	"io/ioutil"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/crypto/bcrypt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	_ "regexp"
+	"strings"
+	"time"
 )
 
 var image_url = "https://golang.org/doc/gopher/frontpage.png"
@@ -30,8 +42,10 @@ func newUserModel() UserModel {
 }
 
 func userModelMocker(n int) []UserModel {
-	var offset int
-	test_db.Model(&UserModel{}).Count(&offset)
+	// Numbered after the last user rather than counted, accounts get deleted by the tests.
+	var last UserModel
+	test_db.Order("id desc").First(&last)
+	offset := int(last.ID)
 	var ret []UserModel
 	for i := offset + 1; i <= offset+n; i++ {
 		image := fmt.Sprintf("http://image/%v.jpg", i)
@@ -85,12 +99,1099 @@ func TestUserModel(t *testing.T) {
 	asserts.Equal(2, len(a.GetFollowings()), "GetFollowings be right after a following c")
 	asserts.EqualValues(b, a.GetFollowings()[0], "GetFollowings should be right")
 	asserts.EqualValues(c, a.GetFollowings()[1], "GetFollowings should be right")
+	followers, count, err := b.GetFollowers(20, 0)
+	asserts.NoError(err)
+	asserts.Equal(1, count, "GetFollowers should count the followers")
+	asserts.Equal(a.ID, followers[0].ID, "GetFollowers should be right")
+	followings, count, err := a.GetFollowingsPage(1, 1)
+	asserts.NoError(err)
+	asserts.Equal(2, count, "GetFollowingsPage should count every following")
+	asserts.Equal(c.ID, followings[0].ID, "GetFollowingsPage should be paginated")
 	a.unFollowing(b)
 	asserts.Equal(1, len(a.GetFollowings()), "GetFollowings should be right after a unFollowing b")
 	asserts.EqualValues(c, a.GetFollowings()[0], "GetFollowings should be right after a unFollowing b")
 	asserts.Equal(false, a.isFollowing(b), "isFollowing should be right after a unFollowing b")
 }
 
+func TestLoginThrottle(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range []LoginAttemptStore{NewMemoryLoginAttemptStore(), NewDBLoginAttemptStore()} {
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		throttle := NewLoginThrottle(store)
+		throttle.Now = func() time.Time { return now }
+
+		wait, err := throttle.Check("user1@linkedin.com", "10.0.0.1")
+		asserts.NoError(err)
+		asserts.Equal(time.Duration(0), wait, "first attempt should not wait")
+
+		throttle.Fail("user1@linkedin.com", "10.0.0.1")
+		wait, _ = throttle.Check("user1@linkedin.com", "10.0.0.1")
+		asserts.Equal(time.Second, wait, "first failure should delay the next attempt")
+
+		now = now.Add(time.Second)
+		throttle.Fail("user1@linkedin.com", "10.0.0.1")
+		wait, _ = throttle.Check("user1@linkedin.com", "10.0.0.1")
+		asserts.Equal(2*time.Second, wait, "delay should grow with the failures")
+
+		for i := 0; i < 3; i++ {
+			now = now.Add(time.Minute)
+			throttle.Fail("user1@linkedin.com", "10.0.0.1")
+		}
+		wait, _ = throttle.Check("user1@linkedin.com", "10.0.0.2")
+		asserts.Equal(15*time.Minute, wait, "email should be locked after 5 failures")
+		wait, _ = throttle.Check("user2@linkedin.com", "10.0.0.1")
+		asserts.Equal(time.Duration(0), wait, "ip should not be locked after 5 failures")
+
+		now = now.Add(15 * time.Minute)
+		wait, _ = throttle.Check("user1@linkedin.com", "10.0.0.1")
+		asserts.Equal(time.Duration(0), wait, "lockout should expire")
+
+		throttle.Fail("user1@linkedin.com", "10.0.0.1")
+		throttle.Succeed("user1@linkedin.com")
+		attempt, _ := store.Get(emailThrottleKey("user1@linkedin.com"))
+		asserts.Equal(0, attempt.Failures, "successful login should clear the email failures")
+		attempt, _ = store.Get(ipThrottleKey("10.0.0.1"))
+		asserts.NotEqual(0, attempt.Failures, "successful login should keep the ip failures")
+	}
+
+	// Another instance counting a failure between the read and the write of the counter.
+	store := NewDBLoginAttemptStore()
+	increment := func(attempt *LoginAttemptModel) { attempt.Failures++ }
+	for _, existing := range []bool{true, false} {
+		key := fmt.Sprintf("email:concurrent-%v@linkedin.com", existing)
+		if existing {
+			store.Update(key, increment)
+		}
+		calls := 0
+		attempt, err := store.Update(key, func(attempt *LoginAttemptModel) {
+			calls++
+			if calls == 1 {
+				store.Update(key, increment)
+			}
+			attempt.Failures++
+		})
+		asserts.NoError(err, "concurrent update should be retried")
+		asserts.Equal(2, calls, "concurrent update should be retried")
+		stored, _ := store.Get(key)
+		if existing {
+			asserts.Equal(3, stored.Failures, "concurrent failures should all be counted")
+		} else {
+			asserts.Equal(2, stored.Failures, "concurrent failures should all be counted")
+		}
+		asserts.Equal(stored.Failures, attempt.Failures, "updated counter should be returned")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	asserts := assert.New(t)
+
+	corpus, err := ioutil.TempFile("", "breached")
+	asserts.NoError(err)
+	defer os.Remove(corpus.Name())
+	fmt.Fprintln(corpus, "# plain text and HIBP formatted entries")
+	fmt.Fprintln(corpus, "letmein123")
+	fmt.Fprintln(corpus, "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:3730471")
+	corpus.Close()
+
+	breached, err := LoadBreachedPasswords(corpus.Name())
+	asserts.NoError(err, "corpus should be loaded")
+	asserts.True(breached.Contains("letmein123"), "plain text entry should be found")
+	asserts.True(breached.Contains("password"), "hashed entry should be found")
+	asserts.False(breached.Contains("correct horse battery staple"), "unknown password should not be found")
+	asserts.Len(breached.Range("5BAA6"), 1, "range should return the suffixes of a prefix")
+
+	policy := PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      255,
+		RequireDigit:   true,
+		MinClasses:     3,
+		RejectIdentity: true,
+		Breached:       breached,
+	}
+	var policyTests = []struct {
+		password string
+		message  string
+		msg      string
+	}{
+		{"Tr0ub4dor&3", "", "strong password should be accepted"},
+		{"Sh0rt", "{min: 8}", "short password should be rejected"},
+		{"NoDigitsHere!", "{key: digit}", "password without digit should be rejected"},
+		{"lowercase123", "{classes: 3}", "password with two classes should be rejected"},
+		{"Wangzitian0!", "{key: identity}", "password containing the username should be rejected"},
+		{"Wzt@gg.cn1", "{key: identity}", "password containing the email should be rejected"},
+		{"letmein123", "{classes: 3}", "weak breached password should be rejected"},
+	}
+	for _, testData := range policyTests {
+		err := policy.Validate(testData.password, "wangzitian0", "wzt@gg.cn")
+		if testData.message == "" {
+			asserts.NoError(err, testData.msg)
+			continue
+		}
+		asserts.Equal(common.FieldError{Field: "Password", Message: testData.message}, err, testData.msg)
+	}
+
+	policy.MinClasses = 0
+	asserts.Equal(common.FieldError{Field: "Password", Message: "{key: breached}"}, policy.Validate("letmein123", "wangzitian0", "wzt@gg.cn"),
+		"breached password should be rejected")
+
+	env := map[string]string{
+		"PASSWORD_MIN_LENGTH":      "12",
+		"PASSWORD_REQUIRE":         "upper, symbol",
+		"PASSWORD_REJECT_IDENTITY": "false",
+		"BREACHED_PASSWORDS_FILE":  corpus.Name(),
+	}
+	getenv := func(key string) string { return env[key] }
+	loaded, err := LoadPasswordPolicy(DefaultPasswordPolicy, getenv)
+	asserts.NoError(err, "policy should be read from the environment")
+	asserts.Equal(12, loaded.MinLength, "minimum length should be read")
+	asserts.Equal(DefaultPasswordPolicy.MaxLength, loaded.MaxLength, "unset rule should keep its default")
+	asserts.True(loaded.RequireUpper && loaded.RequireSymbol && !loaded.RequireDigit, "required classes should be read")
+	asserts.False(loaded.RejectIdentity, "identity rule should be read")
+	asserts.True(loaded.Breached.Contains("letmein123"), "breached corpus should be loaded")
+	asserts.Equal(common.FieldError{Field: "Password", Message: "{key: symbol}"}, loaded.Validate("Wangzitian012", "wangzitian0", "wzt@gg.cn"),
+		"loaded policy should be applied")
+	for key, value := range map[string]string{
+		"PASSWORD_MIN_LENGTH":  "-1",
+		"PASSWORD_MAX_LENGTH":  "6",
+		"PASSWORD_MIN_CLASSES": "5",
+		"PASSWORD_REQUIRE":     "emoji",
+	} {
+		env = map[string]string{key: value}
+		_, err := LoadPasswordPolicy(DefaultPasswordPolicy, getenv)
+		asserts.Error(err, "invalid "+key+" should be refused")
+	}
+}
+
+// The validator of gin, with the exists tag of the older validator taken as always satisfied.
+type existsValidator struct {
+	validate *validator.Validate
+}
+
+func newExistsValidator() existsValidator {
+	validate := validator.New()
+	validate.SetTagName("binding")
+	validate.RegisterValidation("exists", func(validator.FieldLevel) bool { return true })
+	return existsValidator{validate}
+}
+
+func (v existsValidator) ValidateStruct(obj interface{}) error {
+	return v.validate.Struct(obj)
+}
+
+func (v existsValidator) Engine() interface{} {
+	return v.validate
+}
+
+func TestPasswordPolicyBinding(t *testing.T) {
+	asserts := assert.New(t)
+	defer func(validator binding.StructValidator) { binding.Validator = validator }(binding.Validator)
+	binding.Validator = newExistsValidator()
+	defer func(policy PasswordPolicy) { DefaultPasswordPolicy = policy }(DefaultPasswordPolicy)
+
+	bind := func(validator interface{ Bind(*gin.Context) error }, password string) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		body := fmt.Sprintf(`{"user":{"username":"binding0","email":"binding0@g.cn","password":%q}}`, password)
+		c.Request, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		return validator.Bind(c)
+	}
+	var policyTests = []struct {
+		env      map[string]string
+		password string
+		err      error
+		msg      string
+	}{
+		{map[string]string{"PASSWORD_MIN_LENGTH": "6"}, "Pa55wd", nil, "password shorter than 8 should follow PASSWORD_MIN_LENGTH"},
+		{map[string]string{"PASSWORD_MIN_LENGTH": "12"}, "Pa55word10", common.FieldError{Field: "Password", Message: "{min: 12}"},
+			"password longer than 8 should follow PASSWORD_MIN_LENGTH"},
+		{map[string]string{"PASSWORD_MAX_LENGTH": "300"}, strings.Repeat("Pa55", 70), nil, "password longer than 255 should follow PASSWORD_MAX_LENGTH"},
+	}
+	for _, testData := range policyTests {
+		policy, err := LoadPasswordPolicy(PasswordPolicy{MinLength: 8, MaxLength: 255}, func(key string) string { return testData.env[key] })
+		asserts.NoError(err, "policy should be read from the environment")
+		DefaultPasswordPolicy = policy
+		userModelValidator := NewUserModelValidator()
+		asserts.Equal(testData.err, bind(&userModelValidator, testData.password), testData.msg)
+	}
+	loginValidator := NewLoginValidator()
+	asserts.NoError(bind(&loginValidator, "Pa55wd"), "login should not check the length of the password")
+}
+
+func TestPasswordHashers(t *testing.T) {
+	asserts := assert.New(t)
+	defer func(hasher PasswordHasher) { CurrentPasswordHasher = hasher }(CurrentPasswordHasher)
+
+	users := userModelMocker(1)
+	userModel := users[0]
+	asserts.True(BcryptHasher{}.Recognizes(userModel.PasswordHash), "mocked password should use bcrypt")
+
+	//Raising the bcrypt cost should rehash on the next successful check
+	CurrentPasswordHasher = BcryptHasher{Cost: bcrypt.DefaultCost + 1}
+	asserts.NoError(userModel.rehashPassword("password123"), "password should be rehashed")
+	cost, _ := bcrypt.Cost([]byte(userModel.PasswordHash))
+	asserts.Equal(bcrypt.DefaultCost+1, cost, "password should use the new cost")
+
+	//Switching to argon2id should keep the old hashes valid until they are rehashed
+	argon2id := NewArgon2idHasher()
+	argon2id.Memory = 1024
+	CurrentPasswordHasher = argon2id
+	userModel, _ = FindOneUser(&UserModel{ID: userModel.ID})
+	asserts.NoError(userModel.checkPassword("password123"), "bcrypt hash should still be checked")
+	asserts.NoError(userModel.rehashPassword("password123"), "password should be rehashed")
+	userModel, _ = FindOneUser(&UserModel{ID: userModel.ID})
+	asserts.Regexp(`^\$argon2id\$v=19\$m=1024,t=3,p=2\$`, userModel.PasswordHash, "password should be saved with argon2id")
+	asserts.NoError(userModel.checkPassword("password123"), "argon2id hash should be checked")
+	asserts.Error(userModel.checkPassword("password124"), "wrong password should not match the argon2id hash")
+	asserts.False(CurrentPasswordHasher.NeedsRehash(userModel.PasswordHash), "fresh hash should not need a rehash")
+
+	argon2id.Iterations = 4
+	CurrentPasswordHasher = argon2id
+	asserts.True(CurrentPasswordHasher.NeedsRehash(userModel.PasswordHash), "outdated parameters should need a rehash")
+
+	userModel.PasswordHash = "plain"
+	asserts.Equal(ErrUnknownPasswordHash, userModel.checkPassword("plain"), "unknown hash should not be checked")
+
+	//Tampered parameters should be refused rather than make argon2 panic or allocate without bound
+	salt, key := "c29tZXNhbHRzb21lc2FsdA", "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=3,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=0,p=2$" + salt + "$" + key,
+		"$argon2id$v=19$m=4294967295,t=3,p=2$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=4294967295,p=2$" + salt + "$" + key,
+		"$argon2id$v=19$m=1024,t=3,p=2$" + salt + "$",
+	} {
+		userModel.PasswordHash = hash
+		asserts.Equal(ErrInvalidPasswordHash, userModel.checkPassword("password123"), "out of range parameters should be refused: "+hash)
+	}
+
+	_, err := NewBcryptHasher(bcrypt.MinCost - 1)
+	asserts.Error(err, "bcrypt cost below the minimum should be refused")
+	_, err = NewBcryptHasher(bcrypt.MaxCost + 1)
+	asserts.Error(err, "bcrypt cost above the maximum should be refused")
+	hasher, err := NewBcryptHasher(bcrypt.MinCost)
+	asserts.NoError(err, "bcrypt cost in range should be accepted")
+	hash, _ := hasher.Hash("password123")
+	asserts.False(hasher.NeedsRehash(hash), "fresh bcrypt hash should not need a rehash")
+}
+
+func TestDeleteAccount(t *testing.T) {
+	asserts := assert.New(t)
+
+	// The deleted user isn't the last one, userModelMocker numbers the next users after the last ID.
+	users := userModelMocker(3)
+	c := users[0]
+	a := users[1]
+	b := users[2]
+	c.following(b)
+	b.following(c)
+	a.following(b)
+	test_db.Create(&BlockModel{BlockerID: c.ID, BlockedID: a.ID})
+	test_db.Create(&BlockModel{BlockerID: b.ID, BlockedID: c.ID})
+	test_db.Create(&BlockModel{BlockerID: a.ID, BlockedID: b.ID})
+	test_db.Create(&MuteModel{MuterID: c.ID, MutedID: b.ID})
+	test_db.Create(&MuteModel{MuterID: a.ID, MutedID: c.ID})
+
+	root, _ := ioutil.TempDir("", "media")
+	defer os.RemoveAll(root)
+	defer func(storage common.Storage) { common.MediaStorage = storage }(common.MediaStorage)
+	common.MediaStorage = common.NewLocalStorage(root, "http://localhost:8080/media", []byte("secret"))
+	common.MediaStorage.Put("hooked/1.jpg", strings.NewReader("hooked"), "image/jpeg")
+	c.AvatarKey = "avatars/1/c.jpg"
+	for _, key := range avatarFileKeys(c.AvatarKey) {
+		common.MediaStorage.Put(key, strings.NewReader("avatar"), "image/jpeg")
+	}
+	stored := func(key string) bool {
+		file, err := common.MediaStorage.Get(key)
+		if err == nil {
+			file.Close()
+		}
+		return err == nil
+	}
+
+	accountDeletionHooks = []AccountDeletionHook{func(tx *gorm.DB, userModel UserModel) ([]string, error) {
+		return []string{"hooked/1.jpg"}, errors.New("hook failed")
+	}}
+	defer func() { accountDeletionHooks = nil }()
+	asserts.Error(DeleteAccount(c), "a failing hook should cancel the deletion")
+	_, err := FindOneUser(&UserModel{ID: c.ID})
+	asserts.NoError(err, "user should still exist after a failed deletion")
+	asserts.True(stored("hooked/1.jpg"), "files should be kept when the deletion is rolled back")
+	asserts.True(stored(avatarVariantKey(c.AvatarKey, AvatarProfileVariant)), "avatar should be kept when the deletion is rolled back")
+
+	var hooked UserModel
+	accountDeletionHooks = []AccountDeletionHook{func(tx *gorm.DB, userModel UserModel) ([]string, error) {
+		hooked = userModel
+		return []string{"hooked/1.jpg"}, nil
+	}}
+
+	asserts.NoError(DeleteAccount(c), "account should be deleted")
+	asserts.Equal(c.ID, hooked.ID, "deletion hooks should be called with the user")
+	asserts.False(stored("hooked/1.jpg"), "files returned by the hooks should be removed after the commit")
+	for _, key := range avatarFileKeys(c.AvatarKey) {
+		asserts.False(stored(key), "avatar files should be removed after the commit")
+	}
+	_, err = FindOneUser(&UserModel{ID: c.ID})
+	asserts.Error(err, "deleted user should not be found")
+	var count int
+	test_db.Unscoped().Model(&FollowModel{}).Where("following_id = ? OR followed_by_id = ?", c.ID, c.ID).Count(&count)
+	asserts.Equal(0, count, "following relationships of the deleted user should be removed")
+	asserts.Equal(1, len(a.GetFollowings()), "following relationships of other users should be kept")
+	test_db.Unscoped().Model(&BlockModel{}).Where("blocker_id = ? OR blocked_id = ?", c.ID, c.ID).Count(&count)
+	asserts.Equal(0, count, "blocks by and of the deleted user should be removed")
+	test_db.Unscoped().Model(&MuteModel{}).Where("muter_id = ? OR muted_id = ?", c.ID, c.ID).Count(&count)
+	asserts.Equal(0, count, "mutes by and of the deleted user should be removed")
+	asserts.True(a.isBlocking(b), "blocks of other users should be kept")
+}
+
+func TestExport(t *testing.T) {
+	asserts := assert.New(t)
+	defer func(storage common.Storage) { common.MediaStorage = storage }(common.MediaStorage)
+	common.MediaStorage = common.NewLocalStorage(t.TempDir(), "http://localhost:8080/media", []byte("secret"))
+
+	users := userModelMocker(2)
+	a := users[0]
+	b := users[1]
+	b.following(a)
+
+	exportModel, err := RequestExport(a)
+	asserts.NoError(err, "export should be requested")
+	asserts.Equal(ExportPending, exportModel.Status, "export should be pending at first")
+	_, err = RequestExport(a)
+	asserts.Equal(ErrExportPending, err, "only one export should be pending at a time")
+	_, err = FindOneExport(a, 0)
+	asserts.Error(err, "export 0 should not be found")
+	for i := 0; i < 50 && exportModel.Status == ExportPending; i++ {
+		time.Sleep(10 * time.Millisecond)
+		exportModel, _ = FindOneExport(a, exportModel.ID)
+	}
+	asserts.Equal(ExportReady, exportModel.Status, "export should be ready")
+	_, err = FindOneExport(b, exportModel.ID)
+	asserts.Error(err, "export of another user should not be found")
+	second, err := RequestExport(a)
+	asserts.NoError(err, "a new export should be requested once the previous one is built")
+	for i := 0; i < 50 && second.Status == ExportPending; i++ {
+		time.Sleep(10 * time.Millisecond)
+		second, _ = FindOneExport(a, second.ID)
+	}
+
+	file, err := common.MediaStorage.Get(exportModel.Path)
+	asserts.NoError(err, "archive should be stored")
+	content, _ := ioutil.ReadAll(file)
+	file.Close()
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	asserts.NoError(err, "archive should be a zip file")
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+	}
+	asserts.Equal([]string{"follows.json", "profile.json", "security_events.json"}, names, "archive should contain the profile, the follows and the audit log")
+
+	asserts.NoError(PurgeExpiredExports(exportModel.ExpiresAt), "expired exports should be purged")
+	_, err = common.MediaStorage.Get(exportModel.Path)
+	asserts.True(os.IsNotExist(err), "archive should be removed once expired")
+	_, err = FindOneExport(a, exportModel.ID)
+	asserts.Error(err, "export should be removed once expired")
+}
+
+func TestBlockAndMute(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(3)
+	a := users[0]
+	b := users[1]
+	c := users[2]
+	a.following(b)
+	b.following(a)
+
+	asserts.False(IsBlockedBetween(a, b), "nobody should be blocked at init")
+	asserts.NoError(a.block(b), "block should work")
+	asserts.True(a.isBlocking(b), "isBlocking should be right after a blocking b")
+	asserts.False(b.isBlocking(a), "block should not be mutual")
+	asserts.True(IsBlockedBetween(b, a), "IsBlockedBetween should check both directions")
+	asserts.False(a.isFollowing(b), "block should remove the following of the blocker")
+	asserts.False(b.isFollowing(a), "block should remove the following of the blocked")
+	asserts.Equal([]uint{b.ID}, BlockedUserIDs(a), "BlockedUserIDs should be right for the blocker")
+	asserts.Equal([]uint{a.ID}, BlockedUserIDs(b), "BlockedUserIDs should be right for the blocked")
+
+	asserts.NoError(a.mute(c), "mute should work")
+	asserts.True(a.isMuting(c), "isMuting should be right after a muting c")
+	asserts.Equal([]uint{b.ID, c.ID}, HiddenUserIDs(a), "HiddenUserIDs should contain blocked and muted users")
+	asserts.Equal([]uint(nil), HiddenUserIDs(c), "mute should not hide anything from the muted")
+
+	a.unBlock(b)
+	a.unMute(c)
+	asserts.False(IsBlockedBetween(a, b), "unBlock should work")
+	asserts.False(a.isMuting(c), "unMute should work")
+}
+
+func TestFollowRequests(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(3)
+	a := users[0]
+	b := users[1]
+	c := users[2]
+	a.Private = true
+	test_db.Model(&a).Update("private", true)
+
+	asserts.False(b.CanViewContentOf(a), "private user should be hidden from strangers")
+	asserts.True(a.CanViewContentOf(a), "private user should see their own content")
+	hiddenFrom := func(viewer UserModel) []uint {
+		var ids []uint
+		test_db.Model(&UserModel{}).Where("id IN (?)", PrivateUsersHiddenFrom(viewer)).Pluck("id", &ids)
+		return ids
+	}
+	asserts.Contains(hiddenFrom(b), a.ID, "PrivateUsersHiddenFrom should contain the private user")
+	asserts.NotContains(hiddenFrom(a), a.ID, "PrivateUsersHiddenFrom should not contain the viewer")
+
+	asserts.NoError(b.requestFollowing(a), "follow request should be created")
+	asserts.NoError(c.requestFollowing(a), "follow request should be created")
+	asserts.True(b.hasRequestedFollowing(a), "hasRequestedFollowing should be right after the request")
+	asserts.False(b.isFollowing(a), "follow request should not be a following")
+	requesters, count, _ := a.GetFollowRequests(20, 0)
+	asserts.Equal(2, count, "GetFollowRequests should count the pending requests")
+	asserts.Equal(b.ID, requesters[0].ID, "GetFollowRequests should be right")
+
+	asserts.NoError(a.approveFollowRequest(b), "follow request should be approved")
+	asserts.True(b.isFollowing(a), "approved request should become a following")
+	asserts.False(b.hasRequestedFollowing(a), "approved request should not be pending")
+	asserts.True(b.CanViewContentOf(a), "approved follower should see the private user")
+	asserts.NotContains(hiddenFrom(b), a.ID, "PrivateUsersHiddenFrom should not contain followed users")
+
+	asserts.NoError(a.rejectFollowRequest(c), "follow request should be rejected")
+	asserts.False(c.isFollowing(a), "rejected request should not become a following")
+	asserts.True(gorm.IsRecordNotFoundError(a.rejectFollowRequest(c)), "answered request should not be found")
+	asserts.True(gorm.IsRecordNotFoundError(a.approveFollowRequest(c)), "answered request should not be found")
+
+	asserts.NoError(c.requestFollowing(a), "follow request should be created")
+	test_db.Model(&a).Update("private", false)
+	asserts.NoError(a.approveAllFollowRequests(test_db), "pending requests should be approved when turning public")
+	asserts.True(c.isFollowing(a), "pending request should become a following when turning public")
+	asserts.False(c.hasRequestedFollowing(a), "no request should stay pending when turning public")
+	asserts.NotContains(hiddenFrom(c), a.ID, "public users should not be hidden")
+}
+
+func TestProfileRelations(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(4)
+	a, b, c, d := users[0], users[1], users[2], users[3]
+	a.following(b)
+	c.following(b)
+	b.following(c)
+	a.block(d)
+	a.mute(c)
+	test_db.Model(&d).Update("private", true)
+	a.unBlock(d)
+	a.requestFollowing(d)
+
+	relations, err := loadProfileRelations(a, []uint{b.ID, c.ID, d.ID})
+	asserts.NoError(err, "relations should be loaded")
+	asserts.Equal(map[uint]bool{b.ID: true}, relations.following, "following should be loaded")
+	asserts.Equal(map[uint]bool{c.ID: true}, relations.muting, "muting should be loaded")
+	asserts.Equal(map[uint]bool{}, relations.blocking, "removed blocks should not be loaded")
+	asserts.Equal(map[uint]bool{d.ID: true}, relations.requested, "follow requests should be loaded")
+	asserts.Equal(map[uint]int{b.ID: 2, c.ID: 1}, relations.followers, "followers should be counted")
+	asserts.Equal(map[uint]int{b.ID: 1, c.ID: 1}, relations.followings, "followings should be counted")
+
+	relations, err = loadProfileRelations(UserModel{}, []uint{b.ID})
+	asserts.NoError(err, "relations should be loaded for anonymous viewers")
+	asserts.False(relations.following[b.ID], "anonymous viewers should follow nobody")
+	asserts.Equal(2, relations.followers[b.ID], "followers should be counted for anonymous viewers")
+
+	gin.SetMode(gin.TestMode)
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request, _ = http.NewRequest("GET", "/?limit=1000&offset=-1", nil)
+	limit, offset := paginationQuery(ctx)
+	asserts.Equal([]int{maxPageSize, 0}, []int{limit, offset}, "limit should be clamped")
+	ctx.Set("my_user_model", a)
+	serializer := ProfilesSerializer{ctx, []UserModel{b, c}}
+	profiles := serializer.Response()
+	asserts.Equal([]int{2, 1}, []int{profiles[0].FollowersCount, profiles[1].FollowersCount}, "page of profiles should be serialized")
+	asserts.Equal([]bool{true, true}, []bool{profiles[0].Following, profiles[1].Muting}, "page of profiles should be serialized")
+}
+
+func TestSearchUsers(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(4)
+	for i, update := range []UserModel{
+		{Username: "xiaowang"},
+		{Username: "wangfang"},
+		{Username: "wang"},
+		{Bio: "friend of Wang"},
+	} {
+		test_db.Model(&users[i]).Update(update)
+	}
+
+	userModels, count, err := SearchUsers("WANG", nil, 20, 0)
+	asserts.NoError(err, "SearchUsers should not fail")
+	asserts.Equal(4, count, "SearchUsers should match usernames and bios")
+	var usernames []string
+	for _, userModel := range userModels {
+		usernames = append(usernames, userModel.Username)
+	}
+	asserts.Equal([]string{"wang", "wangfang", "xiaowang", users[3].Username}, usernames,
+		"SearchUsers should rank exact, prefix, substring then bio matches")
+
+	userModels, count, _ = SearchUsers("wang", []uint{users[2].ID}, 1, 0)
+	asserts.Equal(3, count, "SearchUsers should not count excluded users")
+	asserts.Equal("wangfang", userModels[0].Username, "SearchUsers should skip excluded users and paginate")
+
+	_, count, _ = SearchUsers("wang_", nil, 20, 0)
+	asserts.Equal(0, count, "SearchUsers should escape LIKE wildcards")
+	test_db.Model(&users[3]).Update(UserModel{Bio: `100% sure!_\\`})
+	for _, q := range []string{"100%", "sure!_", `!_\\`, "%", "!"} {
+		userModels, count, _ = SearchUsers(q, nil, 20, 0)
+		asserts.Equal(1, count, "SearchUsers should match %q literally", q)
+	}
+	_, count, _ = SearchUsers("sure!%", nil, 20, 0)
+	asserts.Equal(0, count, "SearchUsers should not treat ! as an escape of the query")
+}
+
+func TestSuggestUsers(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(5)
+	a, b, c, d, e := users[0], users[1], users[2], users[3], users[4]
+	a.following(b)
+	a.following(c)
+	b.following(d)
+	c.following(d)
+	b.following(e)
+	c.following(a)
+
+	suggestions, err := SuggestUsers(a, 20)
+	asserts.NoError(err, "SuggestUsers should not fail")
+	asserts.Len(suggestions, 2, "SuggestUsers should leave out the user itself and the followed users")
+	asserts.Equal(d.ID, suggestions[0].UserModel.ID, "SuggestUsers should rank by the number of followers in common")
+	asserts.Equal(fmt.Sprintf("Followed by %s and 1 other you follow", b.Username), suggestions[0].Reason,
+		"SuggestUsers should explain the suggestion")
+	asserts.Equal(e.ID, suggestions[1].UserModel.ID, "SuggestUsers should be right")
+
+	a.block(d)
+	suggestions, _ = SuggestUsers(a, 20)
+	asserts.Len(suggestions, 1, "SuggestUsers should leave out blocked users")
+	suggestions, _ = SuggestUsers(a, 0)
+	asserts.Len(suggestions, 0, "SuggestUsers should be limited")
+
+	friends, err := friendsOfFriends(a, 1)
+	asserts.NoError(err, "friendsOfFriends should not fail")
+	asserts.Equal([]uint{d.ID}, []uint{friends[0].UserID}, "friendsOfFriends should keep the best scored users within its limit")
+
+	// More users suggested than asked for, only the best of them are loaded.
+	var all []uint
+	for _, userModel := range userModelMocker(4) {
+		all = append(all, userModel.ID)
+	}
+	var askedLimit int
+	suggestionSources = append(suggestionSources, func(userModel UserModel, limit int) ([]Suggestion, error) {
+		askedLimit = limit
+		var suggestions []Suggestion
+		for _, id := range all {
+			suggestions = append(suggestions, Suggestion{UserID: id, Score: int(id), Reason: "Everyone"})
+		}
+		return suggestions, nil
+	})
+	defer func() { suggestionSources = suggestionSources[:len(suggestionSources)-1] }()
+	suggestions, err = SuggestUsers(a, 2)
+	asserts.NoError(err, "SuggestUsers should not fail")
+	asserts.Equal(2*suggestionSourceFactor, askedLimit, "every source should be given a limit")
+	asserts.Len(suggestions, 2, "SuggestUsers should be limited")
+	asserts.Equal([]uint{all[3], all[2]}, []uint{suggestions[0].UserID, suggestions[1].UserID}, "SuggestUsers should rank by score")
+	asserts.Equal(suggestions[0].UserID, suggestions[0].UserModel.ID, "the suggested users should be loaded")
+}
+
+func TestAvatar(t *testing.T) {
+	asserts := assert.New(t)
+
+	root, _ := ioutil.TempDir("", "media")
+	defer os.RemoveAll(root)
+	defer func(storage common.Storage) { common.MediaStorage = storage }(common.MediaStorage)
+	common.MediaStorage = common.NewLocalStorage(root, "http://localhost:8080/media", []byte("secret"))
+
+	users := userModelMocker(1)
+	a := users[0]
+
+	picture := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for x := 0; x < 800; x++ {
+		for y := 0; y < 400; y++ {
+			picture.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, picture, nil)
+	// An APP1 segment right after the start of image marker, the place where cameras write the EXIF block.
+	exif := append([]byte{0xff, 0xe1, 0x00, 0x10}, []byte("Exif\x00\x00GPSDATA!")...)
+	upload := append(append(append([]byte{}, encoded.Bytes()[:2]...), exif...), encoded.Bytes()[2:]...)
+
+	asserts.NoError(a.setAvatar(bytes.NewReader(upload)), "avatar should be uploaded")
+	asserts.NotEmpty(a.AvatarKey, "avatar key should be saved")
+	asserts.Equal(common.MediaStorage.URL(avatarVariantKey(a.AvatarKey, AvatarProfileVariant)), *a.Image,
+		"image should point at the profile variant")
+	for _, variant := range AvatarVariants {
+		file, err := common.MediaStorage.Get(avatarVariantKey(a.AvatarKey, variant.Name))
+		asserts.NoError(err, "every variant should be stored")
+		content, _ := ioutil.ReadAll(file)
+		file.Close()
+		asserts.NotContains(string(content), "GPSDATA", "EXIF should be stripped")
+		config, format, _ := image.DecodeConfig(bytes.NewReader(content))
+		size := variant.Size
+		if size > 400 {
+			size = 400
+		}
+		asserts.Equal("jpeg", format, "JPEG avatars should stay JPEG")
+		asserts.Equal([]int{size, size}, []int{config.Width, config.Height}, "variants should be resized squares")
+	}
+
+	previous := a.AvatarKey
+	encoded.Reset()
+	png.Encode(&encoded, picture)
+	asserts.NoError(a.setAvatar(&encoded), "avatar should be replaced")
+	asserts.True(strings.HasSuffix(a.AvatarKey, ".png"), "PNG avatars should stay PNG")
+	_, err := common.MediaStorage.Get(avatarVariantKey(previous, AvatarProfileVariant))
+	asserts.True(os.IsNotExist(err), "previous avatar should be removed")
+
+	err = a.setAvatar(strings.NewReader("<html>not an image</html>"))
+	asserts.Equal(common.FieldError{Field: "Avatar", Message: "{key: type}"}, err, "other content types should be rejected")
+	defer func(size int64) { AvatarMaxSize = size }(AvatarMaxSize)
+	AvatarMaxSize = 100
+	err = a.setAvatar(bytes.NewReader(upload))
+	asserts.Equal(common.FieldError{Field: "Avatar", Message: "{max: 100}"}, err, "large files should be rejected")
+
+	key := a.AvatarKey
+	asserts.NoError(a.removeAvatar(), "avatar should be removed")
+	asserts.Empty(a.AvatarKey, "avatar key should be cleared")
+	_, err = common.MediaStorage.Get(avatarVariantKey(key, AvatarProfileVariant))
+	asserts.True(os.IsNotExist(err), "removed avatar files should be deleted")
+}
+
+func TestProfileFields(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(1)
+	a := users[0]
+	userModel, _ := FindOneUser(&UserModel{ID: a.ID})
+	asserts.Empty(userModel.SocialLinks, "social links should be empty at first")
+
+	links := SocialLinks{"https://github.com/wangzitian0", "https://twitter.com/wangzitian0"}
+	asserts.NoError(a.Update(map[string]interface{}{"website": "https://wangzitian0.dev", "pronouns": "he/him", "social_links": links}),
+		"profile fields should be saved")
+	userModel, _ = FindOneUser(&UserModel{ID: a.ID})
+	asserts.Equal("https://wangzitian0.dev", userModel.Website, "website should be saved")
+	asserts.Equal("he/him", userModel.Pronouns, "pronouns should be saved")
+	asserts.Equal(links, userModel.SocialLinks, "social links should be saved as a list")
+
+	asserts.NoError(a.Update(map[string]interface{}{"social_links": SocialLinks(nil)}), "social links should be cleared")
+	userModel, _ = FindOneUser(&UserModel{ID: a.ID})
+	asserts.Empty(userModel.SocialLinks, "cleared social links should be empty")
+	asserts.Equal([]string{}, userModel.socialLinks(), "responses should get an empty list")
+
+	asserts.True(isHTTPURL("http://example.com/me"), "http URLs should be accepted")
+	for _, link := range []string{"javascript:alert(1)", "ftp://example.com", "example.com", "https://"} {
+		asserts.False(isHTTPURL(link), "only http and https URLs should be accepted: "+link)
+	}
+}
+
+func TestChangeUsername(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(2)
+	a := users[0]
+	b := users[1]
+	oldUsername := a.Username
+	now := time.Now()
+
+	asserts.NoError(a.changeUsername(test_db, "renamed0", now), "username should be changed")
+	asserts.Equal("renamed0", a.Username, "username should be changed")
+	userModel, redirect, err := FindOneUserByUsername(oldUsername)
+	asserts.NoError(err, "old username should still be found")
+	asserts.Equal(a.ID, userModel.ID, "old username should resolve to its user")
+	asserts.Equal(&UsernameRedirect{From: oldUsername, To: "renamed0"}, redirect, "old username should give a redirect hint")
+	_, redirect, _ = FindOneUserByUsername("renamed0")
+	asserts.Nil(redirect, "current username should not give a redirect hint")
+	_, _, err = FindOneUserByUsername("nobody0")
+	asserts.True(gorm.IsRecordNotFoundError(err), "unknown username should not be found")
+
+	err = a.changeUsername(test_db, "renamed1", now.Add(time.Hour))
+	asserts.Equal("Username", err.(common.FieldError).Field, "username should not be changed during the cooldown")
+	asserts.Equal("renamed0", a.Username, "username should not be changed during the cooldown")
+
+	asserts.True(isUsernameReserved(oldUsername, b), "old username should be reserved")
+	asserts.False(isUsernameReserved(oldUsername, a), "old username should not be reserved for its user")
+	asserts.Equal(common.FieldError{Field: "Username", Message: "{key: reserved}"}, b.changeUsername(test_db, oldUsername, now),
+		"old username should not be taken by another user")
+
+	asserts.NoError(a.changeUsername(test_db, oldUsername, now.Add(UsernameChangeCooldown)), "old username should be taken back")
+	asserts.Equal([]string{"renamed0"}, a.previousUsernames(), "history should not contain the current username")
+	asserts.True(isUsernameReserved("renamed0", b), "every old username should be reserved")
+	asserts.True(isUsernameReserved("RENAMED0", b), "old username in another case should be reserved")
+	asserts.True(isUsernameReserved("renarned0", b), "username looking like an old username should be reserved")
+	asserts.True(isUsernameReserved("rеnamed0", b), "old username with a Cyrillic letter should be reserved")
+
+	tx := test_db.Begin()
+	renamed := b
+	asserts.NoError(renamed.changeUsername(tx, "renamed2", now), "username should be changed in the transaction")
+	tx.Rollback()
+	userModel, _ = FindOneUser(&UserModel{ID: b.ID})
+	asserts.Equal(b.Username, userModel.Username, "rolled back rename should not be saved")
+	asserts.Empty(b.previousUsernames(), "rolled back rename should not be saved in the history")
+
+	asserts.NoError(DeleteAccount(a), "account should be deleted")
+	for _, username := range []string{oldUsername, "renamed0"} {
+		asserts.True(isUsernameReserved(username, b), "usernames of a deleted account should stay reserved")
+		_, _, err = FindOneUserByUsername(username)
+		asserts.True(gorm.IsRecordNotFoundError(err), "usernames of a deleted account should not resolve")
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	asserts := assert.New(t)
+
+	inviter := userModelMocker(1)[0]
+	now := time.Now()
+	RegistrationMode = RegistrationInvite
+	defer func() { RegistrationMode = RegistrationOpen }()
+
+	invitationModel, err := newInvitation(inviter, 0, nil, now)
+	asserts.NoError(err, "invitation should be created")
+	asserts.Equal(1, invitationModel.MaxUses, "invitation of a user should be used once by default")
+	asserts.WithinDuration(now.Add(InvitationTTL), *invitationModel.ExpiresAt, time.Second, "invitation of a user should expire by default")
+	_, err = newInvitation(inviter, InvitationMaxUses+1, nil, now)
+	asserts.Equal("MaxUses", err.(common.FieldError).Field, "user should not create an invitation with too many uses")
+	past := now.Add(-time.Hour)
+	_, err = newInvitation(inviter, 1, &past, now)
+	asserts.Equal("ExpiresAt", err.(common.FieldError).Field, "invitation should not be expired when created")
+
+	defer func(quota int) { InvitationQuota = quota }(InvitationQuota)
+	InvitationQuota = 2
+	spare, err := newInvitation(inviter, 1, nil, now)
+	asserts.NoError(err, "invitation within the quota should be created")
+	test_db.Delete(&spare)
+	_, err = newInvitation(inviter, 1, nil, now)
+	asserts.Equal(ErrInvitationQuota, err, "revoked invitations should count in the quota")
+	_, err = newInvitation(inviter, 1, nil, now.Add(InvitationQuotaPeriod+time.Minute))
+	asserts.NoError(err, "quota should be restored after the period")
+	admin := inviter
+	admin.Role = RoleAdmin
+	_, err = newInvitation(admin, 1, nil, now)
+	asserts.NoError(err, "admins should not have a quota")
+	InvitationQuota = 100
+
+	invitee := UserModel{Username: "invitee0", Email: "invitee0@linkedin.com", PasswordHash: "x"}
+	err = registerUser(&invitee, "", now)
+	asserts.Equal(common.FieldError{Field: "InvitationCode", Message: "{key: required}"}, err, "invitation code should be required")
+	err = registerUser(&invitee, "wrongcode", now)
+	asserts.Equal(common.FieldError{Field: "InvitationCode", Message: "{key: invalid}"}, err, "invitation code should be valid")
+	_, err = FindOneUser(&UserModel{Username: "invitee0"})
+	asserts.Error(err, "user should not be created with an invalid code")
+
+	asserts.NoError(registerUser(&invitee, invitationModel.Code, now), "user should sign up with an invitation")
+	inviterModel, err := invitee.invitedBy()
+	asserts.NoError(err, "inviter should be found")
+	asserts.Equal(inviter.ID, inviterModel.ID, "inviter should be found")
+	asserts.Equal([]string{"invitee0"}, invitationModel.invitees(), "invitee should be listed")
+	other := UserModel{Username: "invitee1", Email: "invitee1@linkedin.com", PasswordHash: "x"}
+	err = registerUser(&other, invitationModel.Code, now)
+	asserts.Equal(common.FieldError{Field: "InvitationCode", Message: "{key: used}"}, err, "invitation should not be used more than MaxUses")
+
+	soon := now.Add(time.Hour)
+	adminInvitation, err := newInvitation(admin, 0, &soon, now)
+	asserts.NoError(err, "admin should create an unlimited invitation")
+	asserts.Equal(0, adminInvitation.MaxUses, "admin invitation should be unlimited")
+	err = registerUser(&other, adminInvitation.Code, now.Add(2*time.Hour))
+	asserts.Equal(common.FieldError{Field: "InvitationCode", Message: "{key: expired}"}, err, "expired invitation should not be used")
+	_, err = FindOneInvitation(invitee, adminInvitation.Code)
+	asserts.Error(err, "user should not revoke the invitation of another user")
+
+	RegistrationMode = RegistrationClosed
+	asserts.Equal(ErrRegistrationClosed, registerUser(&other, adminInvitation.Code, now), "nobody should sign up when closed")
+
+	asserts.NoError(DeleteAccount(invitee), "invitee should be deleted")
+	asserts.NoError(DeleteAccount(inviter), "inviter should be deleted")
+	var count int
+	test_db.Unscoped().Model(&InvitationModel{}).Where(InvitationModel{CreatedByID: inviter.ID}).Count(&count)
+	asserts.Equal(0, count, "invitations should be deleted with their creator")
+}
+
+type mailRecorder struct {
+	mails []common.Mail
+}
+
+func (r *mailRecorder) Send(mail common.Mail) error {
+	r.mails = append(r.mails, mail)
+	return nil
+}
+
+func TestEmailChange(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(2)
+	a := users[0]
+	b := users[1]
+	mailer := &mailRecorder{}
+	defaultMailer := common.DefaultMailer
+	common.DefaultMailer = mailer
+	defer func() { common.DefaultMailer = defaultMailer }()
+	now := time.Now()
+
+	_, err := a.requestEmailChange(strings.ToUpper(b.Email), now)
+	asserts.Equal(ErrEmailTaken, err, "email of another user should not be requested")
+	token, err := a.requestEmailChange("changed0@linkedin.com", now)
+	asserts.NoError(err, "email change should be requested")
+	asserts.Len(mailer.mails, 2, "verification link and notice should be sent")
+	asserts.Equal("changed0@linkedin.com", mailer.mails[0].To, "verification link should go to the new address")
+	asserts.Contains(mailer.mails[0].Body, EmailConfirmURL+token, "verification link should contain the token")
+	asserts.Equal(a.Email, mailer.mails[1].To, "notice should go to the old address")
+	asserts.NotContains(mailer.mails[1].Body, token, "notice should not contain the token")
+	asserts.Equal("changed0@linkedin.com", a.pendingEmail(now), "pending email should be found")
+	userModel, _ := FindOneUser(&UserModel{ID: a.ID})
+	asserts.Equal(a.Email, userModel.Email, "email should not change before its confirmation")
+
+	_, err = confirmEmailChange(token, now.Add(EmailChangeTTL))
+	asserts.True(gorm.IsRecordNotFoundError(err), "expired token should not be confirmed")
+	token, _ = a.requestEmailChange("changed0@linkedin.com", now)
+	_, err = confirmEmailChange("wrongtoken", now)
+	asserts.True(gorm.IsRecordNotFoundError(err), "unknown token should not be confirmed")
+	_, err = confirmEmailChange(token, now)
+	asserts.NoError(err, "email change should be confirmed")
+	userModel, _ = FindOneUser(&UserModel{ID: a.ID})
+	asserts.Equal("changed0@linkedin.com", userModel.Email, "email should change once confirmed")
+	asserts.Equal("", a.pendingEmail(now), "pending email should be forgotten once confirmed")
+	_, err = confirmEmailChange(token, now)
+	asserts.True(gorm.IsRecordNotFoundError(err), "token should not be confirmed twice")
+
+	token, _ = b.requestEmailChange("changed1@linkedin.com", now)
+	test_db.Model(&a).Update("email", "changed1@linkedin.com")
+	_, err = confirmEmailChange(token, now)
+	asserts.Equal(ErrEmailTaken, err, "email taken in the meantime should not be confirmed")
+	asserts.True(common.IsUniqueViolation(test_db.Model(&b).Update("email", "changed1@linkedin.com").Error),
+		"unique index of the email should be recognized")
+}
+
+func TestCanonicalIdentities(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("bob@x.com", canonicalEmail(" Bob@X.com "), "email should be lower case and trimmed")
+	asserts.Equal("bob@x.com", canonicalEmail("ｂｏｂ@x.com"), "email should be NFKC normalized")
+	asserts.Equal(usernameSkeleton("userl"), usernameSkeleton("User1"), "confusable digits should give the same skeleton")
+	asserts.Equal(usernameSkeleton("userl"), usernameSkeleton("USERI"), "upper case I should look like l")
+	asserts.Equal(usernameSkeleton("bob"), usernameSkeleton("B0B"), "zero should look like o")
+	asserts.Equal(usernameSkeleton("userl"), usernameSkeleton("üserl"), "accents should be ignored by the skeleton")
+	asserts.NotEqual(usernameSkeleton("userl"), usernameSkeleton("users"), "different usernames should give different skeletons")
+	for _, pair := range [][2]string{{"bill", "blll"}, {"user5", "users"}, {"nn", "m"}} {
+		asserts.NotEqual(usernameSkeleton(pair[0]), usernameSkeleton(pair[1]), "%s and %s should not collide", pair[0], pair[1])
+	}
+	for _, pair := range [][2]string{
+		{"clara", "dara"}, {"arnie", "amie"}, {"vvendy", "wendy"}, {"ARNIE", "AMIE"},
+		{"paypal", "раураl"}, {"apple", "аррlе"}, {"scope", "ѕсоре"}, {"top", "Τορ"}, {"van", "ναn"}, {"ABE", "ΑΒΕ"},
+	} {
+		asserts.Equal(usernameSkeleton(pair[0]), usernameSkeleton(pair[1]), "%s and %s should collide", pair[0], pair[1])
+	}
+	asserts.Equal(usernameSkeleton("wendy"), usernameSkeleton(usernameSkeleton("wendy")), "skeleton should not change when computed again")
+
+	users := userModelMocker(2)
+	a := users[0]
+	b := users[1]
+	asserts.Equal(a.Email, a.EmailCanonical, "canonical email should be filled on create")
+	userModel, err := FindOneUserByEmail(strings.ToUpper(a.Email))
+	asserts.NoError(err, "user should be found by its email in another case")
+	asserts.Equal(a.ID, userModel.ID, "user should be found by its email in another case")
+	userModel, redirect, err := FindOneUserByUsername(strings.ToUpper(a.Username))
+	asserts.NoError(err, "user should be found by its username in another case")
+	asserts.Equal(a.ID, userModel.ID, "user should be found by its username in another case")
+	asserts.Nil(redirect, "username in another case should not give a redirect hint")
+	_, err = FindOneUserByEmail("")
+	asserts.Error(err, "empty email should not find any user")
+
+	asserts.True(isUsernameTaken(strings.ToUpper(a.Username), b), "username in another case should be taken")
+	asserts.False(isUsernameTaken(strings.ToUpper(a.Username), a), "own username should not be taken")
+	confusable := strings.Replace(a.Username, "user", "USER", 1) + "I"
+	test_db.Model(&a).Update("username", a.Username+"l")
+	asserts.Equal(common.FieldError{Field: "Username", Message: "{key: confusable}"}, validateUsername(confusable, b),
+		"username looking like another one should not be valid")
+	asserts.Equal(ErrUsernameTaken, b.changeUsername(test_db, strings.ToUpper(a.Username), time.Now()), "username in another case should not be taken")
+	duplicate := UserModel{Username: "duplicate0", Email: strings.ToUpper(a.Email), PasswordHash: "x"}
+	asserts.True(common.IsUniqueViolation(test_db.Create(&duplicate).Error), "email in another case should violate the unique index")
+
+	asserts.NoError(a.Update(map[string]interface{}{"email": "Changed2@linkedin.com"}), "email should be updated")
+	asserts.NoError(test_db.Model(&UserModel{ID: a.ID}).Update("bio", "bio").Error, "bio should be updated")
+	userModel, _ = FindOneUser(&UserModel{ID: a.ID})
+	asserts.Equal("changed2@linkedin.com", userModel.EmailCanonical, "canonical email should follow the email")
+	asserts.Equal(canonicalUsername(a.Username), userModel.UsernameCanonical, "canonical username should not change with another field")
+
+	asserts.NoError(test_db.Model(&UserModel{}).RemoveIndex(emailCanonicalIndex).Error, "index should be removed")
+	email := b.Email
+	test_db.Model(&b).UpdateColumn("email", "CHANGED2@linkedin.com")
+	collisions, err := MigrateCanonicalIdentities()
+	asserts.NoError(err, "migration should run")
+	asserts.Equal([]IdentityCollision{{Column: "email", Canonical: "changed2@linkedin.com", UserIDs: []uint{a.ID, b.ID}}}, collisions,
+		"colliding emails should be reported")
+	asserts.False(test_db.Dialect().HasIndex("user_models", emailCanonicalIndex), "index should not be created with collisions")
+	test_db.Model(&b).UpdateColumn("email", email)
+	collisions, err = MigrateCanonicalIdentities()
+	asserts.NoError(err, "migration should run")
+	asserts.Empty(collisions, "solved collisions should not be reported")
+	asserts.True(test_db.Dialect().HasIndex("user_models", emailCanonicalIndex), "index should be created once the collisions are solved")
+}
+
+func TestSecurityEvents(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(2)
+	actor := users[0]
+	subject := users[1]
+	newContext := func(userModel UserModel) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/", nil)
+		c.Request.Header.Set("User-Agent", "agent0")
+		c.Set("request_id", "request0")
+		c.Set("my_user_model", userModel)
+		return c, w
+	}
+
+	c, _ := newContext(actor)
+	RecordSecurityEvent(c, EventRoleChanged, subject, map[string]interface{}{"to": RoleModerator})
+	RecordSecurityEvent(c, EventLoginSucceeded, actor, nil)
+	events, count, err := FindSecurityEvents(SecurityEventFilter{UserModelID: subject.ID}, 20, 0)
+	asserts.NoError(err, "events should be found")
+	asserts.Equal(1, count, "only the events of the user should be found")
+	event := events[0]
+	asserts.Equal(EventRoleChanged, event.Type, "event type should be recorded")
+	asserts.Equal(actor.ID, event.ActorID, "actor should be recorded")
+	asserts.Equal("agent0", event.UserAgent, "user agent should be recorded")
+	asserts.Equal("request0", event.RequestID, "request ID should be recorded")
+	asserts.Equal(`{"to":"moderator"}`, event.Details, "details should be recorded")
+	_, count, _ = FindSecurityEvents(SecurityEventFilter{ActorID: actor.ID, Type: EventLoginSucceeded}, 20, 0)
+	asserts.Equal(1, count, "events should be filtered by actor and type")
+	asserts.Equal("s***@example.com", maskEmail("someone@example.com"), "typed emails should be masked")
+	asserts.Equal("***", maskEmail("hunter2"), "typed text which isn't an email should be hidden")
+	asserts.Equal("***@example.com", maskEmail("@example.com"), "empty local parts should be masked")
+
+	asserts.NoError(EnsureRole(subject.Username, RoleAdmin), "admin should be appointed by configuration")
+	admin, _ := FindOneUser(&UserModel{ID: subject.ID})
+	asserts.Equal(RoleAdmin, admin.Role, "admin should be appointed by configuration")
+	_, count, _ = FindSecurityEvents(SecurityEventFilter{UserModelID: subject.ID, Type: EventRoleChanged}, 20, 0)
+	asserts.Equal(2, count, "appointing the admin should be audited")
+	asserts.Error(EnsureRole("nobody0", RoleAdmin), "unknown admin should be reported")
+
+	asserts.Equal(ErrSecurityEventAppendOnly, test_db.Model(&event).Update("type", EventLoginFailed).Error, "event should not be updated")
+	asserts.Equal(ErrSecurityEventAppendOnly, test_db.Delete(&event).Error, "event should not be deleted")
+	data, err := exportSecurityEvents(subject)
+	asserts.NoError(err, "events should be exported")
+	asserts.Contains(string(data["security_events.json"]), EventRoleChanged, "events should be exported")
+
+	asserts.Equal("Role", subject.setRole("superuser").(common.FieldError).Field, "unknown role should not be set")
+	asserts.NoError(subject.setRole(RoleAdmin), "role should be set")
+	for _, userModel := range []UserModel{actor, subject} {
+		c, w := newContext(userModel)
+		RequireRole(RoleAdmin)(c)
+		asserts.Equal(userModel.Role != RoleAdmin, c.IsAborted(), "only admins should get through")
+		if c.IsAborted() {
+			asserts.Equal(http.StatusForbidden, w.Code, "other users should be forbidden")
+		}
+	}
+
+	now := time.Now()
+	authenticate := func() uint {
+		c, _ := newContext(UserModel{})
+		c.Request.Header.Set("Authorization", "Token "+common.GenToken(actor.ID))
+		AuthMiddleware(false)(c)
+		return c.MustGet("my_user_id").(uint)
+	}
+	asserts.Equal(actor.ID, authenticate(), "token should be accepted before the revocation")
+	asserts.NoError(actor.revokeTokens(now.Add(time.Second)), "tokens should be revoked")
+	asserts.True(actor.tokenRevoked(now.Unix()), "token issued before the revocation should be revoked")
+	asserts.Equal(uint(0), authenticate(), "token issued before the revocation should be refused")
+	asserts.NoError(actor.revokeTokens(now.Add(-time.Second)), "tokens should be revoked")
+	asserts.False(actor.tokenRevoked(now.Unix()), "token issued after the revocation should not be revoked")
+	asserts.Equal(actor.ID, authenticate(), "token issued after the revocation should be accepted")
+
+	defer func(validator binding.StructValidator) { binding.Validator = validator }(binding.Validator)
+	binding.Validator = newExistsValidator()
+	defer func(throttle *LoginThrottle) { LoginThrottler = throttle }(LoginThrottler)
+	LoginThrottler = NewLoginThrottle(NewMemoryLoginAttemptStore())
+	c, w := newContext(UserModel{})
+	body := fmt.Sprintf(`{"user":{"email":%q,"password":"wrong password"}}`, strings.ToUpper(subject.Email))
+	c.Request = httptest.NewRequest("POST", "/users/login", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	UsersLogin(c)
+	asserts.Equal(http.StatusForbidden, w.Code, "wrong password should be refused")
+	events, _, _ = FindSecurityEvents(SecurityEventFilter{UserModelID: subject.ID, Type: EventLoginFailed}, 20, 0)
+	asserts.Len(events, 1, "wrong password should be audited")
+	asserts.Equal(fmt.Sprintf(`{"email":%q,"reason":"invalid_password"}`, maskEmail(canonicalEmail(subject.Email))), events[0].Details,
+		"email of a wrong password should be masked")
+}
+
+func TestImpersonation(t *testing.T) {
+	asserts := assert.New(t)
+
+	users := userModelMocker(3)
+	admin, subject, otherAdmin := users[0], users[1], users[2]
+	asserts.NoError(admin.setRole(RoleAdmin), "role should be set")
+	asserts.NoError(otherAdmin.setRole(RoleAdmin), "role should be set")
+	_, _, err := startImpersonation(admin, admin, time.Now())
+	asserts.Error(err, "admin should not impersonate itself")
+	_, _, err = startImpersonation(admin, otherAdmin, time.Now())
+	asserts.Error(err, "admin should not impersonate another admin")
+	_, _, err = startImpersonation(subject, admin, time.Now())
+	asserts.Error(err, "only admins should impersonate")
+
+	r := gin.New()
+	r.Use(AuthMiddleware(false))
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	adminGroup := r.Group("/admin")
+	adminGroup.Use(RequireRole(RoleAdmin))
+	AdminRegister(adminGroup)
+	request := func(method, url, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/admin/users/"+subject.Username+"/impersonate", common.GenToken(admin.ID))
+	asserts.Equal(http.StatusOK, w.Code, "admin should get an impersonation token")
+	token, expiresAt, err := startImpersonation(admin, subject, time.Now())
+	asserts.NoError(err, "admin should impersonate a user")
+	asserts.WithinDuration(time.Now().Add(ImpersonationTTL), expiresAt, time.Second, "token should be short-lived")
+
+	w = request("GET", "/user/", token)
+	asserts.Equal(http.StatusOK, w.Code, "impersonation token should authenticate")
+	asserts.Contains(w.Body.String(), `"username":"`+subject.Username+`"`, "request should be made as the subject")
+	asserts.Contains(w.Body.String(), `"token":"`+token+`"`, "response should not issue a regular token of the subject")
+	asserts.Equal(http.StatusForbidden, request("POST", "/user/tokens/revoke", token).Code, "tokens should not be revoked while impersonating")
+	asserts.Equal(http.StatusForbidden, request("GET", "/admin/security-events", token).Code, "admin routes should not be reached while impersonating")
+	w = request("PUT", "/user/", token)
+	asserts.Equal(http.StatusForbidden, w.Code, "the profile should not be changed while impersonating")
+	asserts.Contains(w.Body.String(), ErrImpersonationNotAllowed.Error(), "the profile should not be changed while impersonating")
+	asserts.Equal(http.StatusForbidden, request("POST", "/user/export", token).Code, "exports should not be requested while impersonating")
+	asserts.Equal(http.StatusForbidden, request("GET", "/user/export/1/download", token).Code, "exports should not be downloaded while impersonating")
+	var exports int
+	test_db.Model(&ExportModel{}).Where("user_model_id = ?", subject.ID).Count(&exports)
+	asserts.Equal(0, exports, "exports should not be requested while impersonating")
+
+	events, count, _ := FindSecurityEvents(SecurityEventFilter{UserModelID: subject.ID, ActorID: admin.ID, Type: EventImpersonatedRequest}, 20, 0)
+	asserts.Equal(6, count, "every request should be audited once")
+	asserts.Equal(`{"method":"GET","path":"/user/","status":200}`, events[5].Details, "request should be audited with its status")
+	asserts.Equal(`{"method":"PUT","path":"/user/","status":403}`, events[2].Details, "refused request should be audited")
+	_, count, _ = FindSecurityEvents(SecurityEventFilter{UserModelID: subject.ID, ActorID: admin.ID, Type: EventImpersonationStarted}, 20, 0)
+	asserts.Equal(1, count, "impersonation should be audited")
+
+	w = httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("impersonator_model", admin)
+	asserts.True(forbidImpersonation(c), "password and email changes should be refused while impersonating")
+	asserts.Equal(http.StatusForbidden, w.Code, "password and email changes should be refused while impersonating")
+
+	asserts.NoError(admin.setRole(""), "role should be removed")
+	asserts.Equal(http.StatusUnauthorized, request("GET", "/user/", token).Code, "token should stop working once the actor isn't an admin")
+}
+
 //Reset test DB and create new one with mock data
 func resetDBWithMock() {
 	common.TestDBFree(test_db)
@@ -125,7 +1226,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusCreated,
-		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"wangzitian0","email":"wzt@gg.cn","bio":"","image":null,"website":"","location":"","pronouns":"","socialLinks":\[\],"private":false,"token":"([a-zA-Z0-9-_.]{137})"}}`,
 		"valid data and should return StatusCreated",
 	},
 	{
@@ -133,9 +1234,9 @@ var unauthRequestTests = []struct {
 		"/users/",
 		"POST",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
-		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
-		"duplicated data and should return StatusUnprocessableEntity",
+		http.StatusConflict,
+		`{"errors":{"username":"Username is already taken"}}`,
+		"duplicated data and should return StatusConflict",
 	},
 	{
 		func(req *http.Request) {},
@@ -174,7 +1275,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		`{"user":{"email": "user1@linkedin.com","password": "password123"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"private":false,"token":"([a-zA-Z0-9-_.]{137})"}}`,
 		"right info login should return user",
 	},
 	{
@@ -245,7 +1346,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user1","email":"user1@linkedin.com","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"private":false,"token":"([a-zA-Z0-9-_.]{137})"}}`,
 		"request should return current user with token",
 	},
 
@@ -259,7 +1360,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"request should return self profile",
 	},
 	{
@@ -270,7 +1371,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"request should return correct other's profile",
 	},
 
@@ -293,10 +1394,21 @@ var unauthRequestTests = []struct {
 		},
 		"/user/",
 		"PUT",
-		`{"user":{"username":"user123","password": "password126","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg"}}`,
+		`{"user":{"username":"user123","password": "password126","email":"user123@linkedin.com","currentPassword":"password123","bio":"bio123","image":"http://hehe/123.jpg"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
-		"current user profile should be changed",
+		`{"pendingEmail":"user123@linkedin.com","user":{"username":"user123","email":"user1@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"private":false,"token":"([a-zA-Z0-9-_.]{137})"}}`,
+		"current user profile should be changed and the new email should wait for its confirmation",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/user/",
+		"PUT",
+		`{"user":{"email":"user2@linkedin.com","currentPassword":"password126"}}`,
+		http.StatusConflict,
+		`{"errors":{"email":"Email is already taken"}}`,
+		"email of another user should not be requested",
 	},
 	{
 		func(req *http.Request) {
@@ -306,16 +1418,27 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user123","bio":"bio123","image":"http://hehe/123.jpg","following":false}}`,
+		`{"profile":{"username":"user123","bio":"bio123","image":"http://hehe/123.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"request should return self profile after changed",
 	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/profiles/user1",
+		"GET",
+		``,
+		http.StatusOK,
+		`{"profile":{"username":"user123","bio":"bio123","image":"http://hehe/123.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false},"redirect":{"from":"user1","to":"user123"}}`,
+		"request should redirect the old username to the new one",
+	},
 	{
 		func(req *http.Request) {},
 		"/users/login",
 		"POST",
-		`{"user":{"email": "user123@linkedin.com","password": "password126"}}`,
+		`{"user":{"email": "user1@linkedin.com","password": "password126"}}`,
 		http.StatusOK,
-		`{"user":{"username":"user123","email":"user123@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","token":"([a-zA-Z0-9-_.]{115})"}}`,
+		`{"user":{"username":"user123","email":"user1@linkedin.com","bio":"bio123","image":"http://hehe/123.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"private":false,"token":"([a-zA-Z0-9-_.]{137})"}}`,
 		"user should login using new password after changed",
 	},
 	{
@@ -351,8 +1474,8 @@ var unauthRequestTests = []struct {
 		"PUT",
 		`{"user":{"username": "wangzitian0","email": "wzt@gg.cn","password": "jakejxke"}}`,
 		http.StatusUnprocessableEntity,
-		`{"errors":{"database":"UNIQUE constraint failed: user_models.email"}}`,
-		"cheat validator and test database connecting error for user update",
+		`{"errors":{"CurrentPassword":"{key: required}"}}`,
+		"cheat validator and test email change without the current password for user update",
 	},
 	{
 		func(req *http.Request) {
@@ -415,7 +1538,7 @@ var unauthRequestTests = []struct {
 		"POST",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":true,"followersCount":1,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"user follow another should work",
 	},
 	{
@@ -426,9 +1549,75 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":true}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":true,"followersCount":1,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"user follow another should make sure database changed",
 	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 3)
+		},
+		"/profiles/user1/followers",
+		"GET",
+		``,
+		http.StatusOK,
+		`{"profiles":\[{"username":"user2","bio":"bio2","image":"http://image/2.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":1,"blocking":false,"muting":false,"private":false,"followRequested":false}\],"profilesCount":1}`,
+		"followers of a user should be listed",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 3)
+		},
+		"/profiles/user2/following?limit=1&offset=1",
+		"GET",
+		``,
+		http.StatusOK,
+		`{"profiles":\[\],"profilesCount":1}`,
+		"following list should be paginated",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 3)
+		},
+		"/profiles/?q=USER2",
+		"GET",
+		``,
+		http.StatusOK,
+		`{"profiles":\[{"username":"user2","bio":"bio2","image":"http://image/2.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":1,"blocking":false,"muting":false,"private":false,"followRequested":false}\],"profilesCount":1}`,
+		"users should be searched by username",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/user/suggestions",
+		"GET",
+		``,
+		http.StatusOK,
+		`{"suggestions":\[\]}`,
+		"users following nobody should get no suggestion",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/user/invitations",
+		"POST",
+		`{"invitation":{"maxUses":2}}`,
+		http.StatusCreated,
+		`{"invitation":{"code":"([a-f0-9]{16})","maxUses":2,"uses":0,"createdAt":"[^"]+","expiresAt":"[^"]+","invitees":\[\]}}`,
+		"user should create an invitation",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/user/invitations",
+		"POST",
+		`{"invitation":{"maxUses":6}}`,
+		http.StatusUnprocessableEntity,
+		`{"errors":{"MaxUses":"{max: 5}"}}`,
+		"user should not create an invitation with too many uses",
+	},
 	{
 		func(req *http.Request) {
 			HeaderTokenMock(req, 2)
@@ -437,7 +1626,7 @@ var unauthRequestTests = []struct {
 		"DELETE",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"user cancel follow another should work",
 	},
 	{
@@ -448,7 +1637,7 @@ var unauthRequestTests = []struct {
 		"GET",
 		``,
 		http.StatusOK,
-		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","website":"","location":"","pronouns":"","socialLinks":\[\],"following":false,"followersCount":0,"followingCount":0,"blocking":false,"muting":false,"private":false,"followRequested":false}}`,
 		"user cancel follow another should make sure database changed",
 	},
 }
@@ -0,0 +1,135 @@
+package users
+
+import (
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// An old username of a user, CreatedAt is when it was changed.
+// Old usernames keep resolving to their user and nobody else can take them, nor a username looking like them.
+type UsernameHistoryModel struct {
+	gorm.Model
+	UserModel        UserModel
+	UserModelID      uint
+	Username         string `gorm:"unique_index"`
+	UsernameSkeleton string `gorm:"index"`
+}
+
+// Keep the skeleton in sync with the username, see usernameSkeleton.
+func (h *UsernameHistoryModel) BeforeSave(scope *gorm.Scope) error {
+	return scope.SetColumn("UsernameSkeleton", usernameSkeleton(h.Username))
+}
+
+// Fill the skeletons of the usernames which were in the history before it had one, or whose skeleton changed
+// with usernameConfusables.
+func migrateUsernameHistorySkeletons(db *gorm.DB) error {
+	var histories []UsernameHistoryModel
+	if err := db.Unscoped().Select("id, username, username_skeleton").Find(&histories).Error; err != nil {
+		return err
+	}
+	for _, history := range histories {
+		skeleton := usernameSkeleton(history.Username)
+		if history.UsernameSkeleton == skeleton {
+			continue
+		}
+		err := db.Unscoped().Model(&UsernameHistoryModel{}).Where("id = ?", history.ID).
+			UpdateColumn("username_skeleton", skeleton).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How long a user has to wait between two username changes.
+var UsernameChangeCooldown = 30 * 24 * time.Hour
+
+// The hint returned when a request used an old username, clients should update their links to To.
+type UsernameRedirect struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// You could check whether username is, or looks like, an old username of another user than userModel.
+// 	if isUsernameReserved("username0", myUserModel) { ... }
+func isUsernameReserved(username string, u UserModel) bool {
+	db := common.GetDB()
+	var history UsernameHistoryModel
+	db.Unscoped().Where("username_skeleton = ? AND user_model_id <> ?", usernameSkeleton(username), u.ID).First(&history)
+	return history.ID != 0
+}
+
+// You could rename a user, the old username goes to the history so it keeps pointing at the user.
+// Taking back one of its own old usernames is allowed. It returns a common.FieldError on "Username"
+// when the username is reserved by another user, looks like the one of another user or when the last change is more
+// recent than UsernameChangeCooldown. ErrUsernameTaken is returned when another user has the same canonical username.
+// The rename is written with tx, so it is committed or rolled back with the rest of the profile update.
+// 	err := myUserModel.changeUsername(tx, "username1", time.Now())
+func (u *UserModel) changeUsername(tx *gorm.DB, username string, now time.Time) error {
+	if username == u.Username {
+		return nil
+	}
+	if isUsernameReserved(username, *u) {
+		return common.FieldError{Field: "Username", Message: "{key: reserved}"}
+	}
+	if isUsernameTaken(username, *u) {
+		return ErrUsernameTaken
+	}
+	if err := validateUsername(username, *u); err != nil {
+		return err
+	}
+	var last UsernameHistoryModel
+	tx.Unscoped().Where(UsernameHistoryModel{UserModelID: u.ID}).Order("created_at DESC").First(&last)
+	if last.ID != 0 && now.Before(last.CreatedAt.Add(UsernameChangeCooldown)) {
+		return common.FieldError{Field: "Username", Message: "{cooldown: " + last.CreatedAt.Add(UsernameChangeCooldown).UTC().Format(time.RFC3339) + "}"}
+	}
+
+	err := tx.Unscoped().Where("username IN (?) AND user_model_id = ?", []string{username, u.Username}, u.ID).
+		Delete(UsernameHistoryModel{}).Error
+	if err == nil {
+		err = tx.Create(&UsernameHistoryModel{Model: gorm.Model{CreatedAt: now}, UserModelID: u.ID, Username: u.Username}).Error
+	}
+	if err == nil {
+		err = tx.Model(u).Update("username", username).Error
+	}
+	return err
+}
+
+// The usernames of a deleted user stay in the history, so nobody can take its handles over.
+func reserveUsernames(tx *gorm.DB, u UserModel, now time.Time) error {
+	return tx.Create(&UsernameHistoryModel{Model: gorm.Model{CreatedAt: now}, UserModelID: u.ID, Username: u.Username}).Error
+}
+
+// You could find a user by its current username or by an old one, a redirect hint is returned in the second case.
+// The case of the username doesn't matter, see canonicalUsername.
+// 	userModel, redirect, err := FindOneUserByUsername("username0")
+func FindOneUserByUsername(username string) (UserModel, *UsernameRedirect, error) {
+	if canonicalUsername(username) == "" {
+		return UserModel{}, nil, gorm.ErrRecordNotFound
+	}
+	userModel, err := FindOneUser(&UserModel{UsernameCanonical: canonicalUsername(username)})
+	if err == nil || !gorm.IsRecordNotFoundError(err) {
+		return userModel, nil, err
+	}
+	db := common.GetDB()
+	var history UsernameHistoryModel
+	if err := db.Unscoped().Where("LOWER(username) = ?", canonicalUsername(username)).First(&history).Error; err != nil {
+		return userModel, nil, err
+	}
+	userModel, err = FindOneUser(&UserModel{ID: history.UserModelID})
+	if err != nil {
+		return userModel, nil, err
+	}
+	return userModel, &UsernameRedirect{From: username, To: userModel.Username}, nil
+}
+
+// The old usernames of a user, the most recent first.
+func (u UserModel) previousUsernames() []string {
+	db := common.GetDB()
+	var usernames []string
+	db.Unscoped().Model(&UsernameHistoryModel{}).Where(UsernameHistoryModel{UserModelID: u.ID}).
+		Order("created_at DESC").Pluck("username", &usernames)
+	return append([]string{}, usernames...)
+}
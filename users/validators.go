@@ -1,6 +1,10 @@
 package users
 
 import (
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gin-gonic/gin"
 )
@@ -11,11 +15,20 @@ import (
 // Then, you can just call model.save() after the data is ready in DataModel.
 type UserModelValidator struct {
 	User struct {
-		Username string `form:"username" json:"username" binding:"exists,alphanum,min=4,max=255"`
-		Email    string `form:"email" json:"email" binding:"exists,email"`
-		Password string `form:"password" json:"password" binding:"exists,min=8,max=255"`
-		Bio      string `form:"bio" json:"bio" binding:"max=1024"`
-		Image    string `form:"image" json:"image" binding:"omitempty,url"`
+		Username    string   `form:"username" json:"username" binding:"exists,alphanum,min=4,max=255"`
+		Email       string   `form:"email" json:"email" binding:"exists,email"`
+		Password    string   `form:"password" json:"password" binding:"exists"`
+		Bio         string   `form:"bio" json:"bio" binding:"max=1024"`
+		Image       string   `form:"image" json:"image" binding:"omitempty,url"`
+		Private     bool     `form:"private" json:"private"`
+		Website     string   `form:"website" json:"website" binding:"max=255"`
+		Location    string   `form:"location" json:"location" binding:"max=100"`
+		Pronouns    string   `form:"pronouns" json:"pronouns" binding:"max=40"`
+		SocialLinks []string `form:"socialLinks" json:"socialLinks" binding:"max=10,dive,max=255"`
+		// Only read on registration, see RegistrationMode.
+		InvitationCode string `form:"invitationCode" json:"invitationCode" binding:"max=64"`
+		// Only read on update, changing the email needs the current password.
+		CurrentPassword string `form:"currentPassword" json:"currentPassword"`
 	} `json:"user"`
 	userModel UserModel `json:"-"`
 }
@@ -31,9 +44,29 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	self.userModel.Username = self.User.Username
 	self.userModel.Email = self.User.Email
 	self.userModel.Bio = self.User.Bio
+	self.userModel.Private = self.User.Private
+	self.userModel.Website = strings.TrimSpace(self.User.Website)
+	self.userModel.Location = strings.TrimSpace(self.User.Location)
+	self.userModel.Pronouns = strings.TrimSpace(self.User.Pronouns)
+	self.userModel.SocialLinks = SocialLinks{}
+	if self.userModel.Website != "" && !isHTTPURL(self.userModel.Website) {
+		return common.FieldError{Field: "Website", Message: "{key: url}"}
+	}
+	for _, link := range self.User.SocialLinks {
+		link = strings.TrimSpace(link)
+		if !isHTTPURL(link) {
+			return common.FieldError{Field: "SocialLinks", Message: "{key: url}"}
+		}
+		self.userModel.SocialLinks = append(self.userModel.SocialLinks, link)
+	}
 
 	if self.User.Password != common.NBRandomPassword {
-		self.userModel.setPassword(self.User.Password)
+		if err := DefaultPasswordPolicy.Validate(self.User.Password, self.User.Username, self.User.Email); err != nil {
+			return err
+		}
+		if err := self.userModel.setPassword(self.User.Password); err != nil {
+			return common.FieldError{Field: "Password", Message: err.Error()}
+		}
 	}
 	if self.User.Image != "" {
 		self.userModel.Image = &self.User.Image
@@ -41,6 +74,12 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	return nil
 }
 
+// The url binding tag accepts any scheme, the links shown on a profile have to be http or https ones.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
 // You can put the default value of a Validator here
 func NewUserModelValidator() UserModelValidator {
 	userModelValidator := UserModelValidator{}
@@ -53,6 +92,11 @@ func NewUserModelValidatorFillWith(userModel UserModel) UserModelValidator {
 	userModelValidator.User.Username = userModel.Username
 	userModelValidator.User.Email = userModel.Email
 	userModelValidator.User.Bio = userModel.Bio
+	userModelValidator.User.Private = userModel.Private
+	userModelValidator.User.Website = userModel.Website
+	userModelValidator.User.Location = userModel.Location
+	userModelValidator.User.Pronouns = userModel.Pronouns
+	userModelValidator.User.SocialLinks = append([]string{}, userModel.SocialLinks...)
 	userModelValidator.User.Password = common.NBRandomPassword
 
 	if userModel.Image != nil {
@@ -64,7 +108,7 @@ func NewUserModelValidatorFillWith(userModel UserModel) UserModelValidator {
 type LoginValidator struct {
 	User struct {
 		Email    string `form:"email" json:"email" binding:"exists,email"`
-		Password string `form:"password"json:"password" binding:"exists,min=8,max=255"`
+		Password string `form:"password" json:"password" binding:"exists"`
 	} `json:"user"`
 	userModel UserModel `json:"-"`
 }
@@ -84,3 +128,64 @@ func NewLoginValidator() LoginValidator {
 	loginValidator := LoginValidator{}
 	return loginValidator
 }
+
+// Deleting an account can't be undone, so the password is asked again.
+type AccountDeletionValidator struct {
+	User struct {
+		Password string `form:"password" json:"password" binding:"required"`
+	} `json:"user"`
+}
+
+func (self *AccountDeletionValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewAccountDeletionValidator() AccountDeletionValidator {
+	return AccountDeletionValidator{}
+}
+
+// The admins choose any limits for their invitations, see newInvitation for the other users.
+type InvitationModelValidator struct {
+	Invitation struct {
+		MaxUses   int        `form:"maxUses" json:"maxUses"`
+		ExpiresAt *time.Time `form:"expiresAt" json:"expiresAt"`
+	} `json:"invitation"`
+}
+
+func (self *InvitationModelValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewInvitationModelValidator() InvitationModelValidator {
+	return InvitationModelValidator{}
+}
+
+// The token of the verification link sent to the new email address.
+type EmailConfirmValidator struct {
+	User struct {
+		Token string `form:"token" json:"token" binding:"required,max=128"`
+	} `json:"user"`
+}
+
+func (self *EmailConfirmValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewEmailConfirmValidator() EmailConfirmValidator {
+	return EmailConfirmValidator{}
+}
+
+// An admin changing the role of a user, see RoleModerator and RoleAdmin.
+type RoleValidator struct {
+	User struct {
+		Role string `form:"role" json:"role" binding:"max=32"`
+	} `json:"user"`
+}
+
+func (self *RoleValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
+
+func NewRoleValidator() RoleValidator {
+	return RoleValidator{}
+}